@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/kontena/pharos-host-upgrades/hosts"
+)
+
+// optional file in the --config-path
+const BlackoutConfig = "blackout.yml"
+
+// no upgrades or reboots from the start time until the end time
+type BlackoutPeriod struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (period BlackoutPeriod) String() string {
+	if period.Reason == "" {
+		return fmt.Sprintf("%v - %v", period.From, period.To)
+	} else {
+		return fmt.Sprintf("%v - %v (%v)", period.From, period.To, period.Reason)
+	}
+}
+
+func (period BlackoutPeriod) Contains(t time.Time) bool {
+	return !t.Before(period.From) && t.Before(period.To)
+}
+
+type Blackout []BlackoutPeriod
+
+func loadBlackout(config hosts.Config) (Blackout, error) {
+	var blackout Blackout
+
+	if exists, err := config.FileExists(BlackoutConfig); err != nil {
+		return nil, err
+	} else if !exists {
+		log.Printf("No %v config, skipping blackout calendar", BlackoutConfig)
+
+		return nil, nil
+	} else if file, err := config.Open(BlackoutConfig); err != nil {
+		return nil, err
+	} else if data, err := ioutil.ReadAll(file); err != nil {
+		file.Close()
+		return nil, err
+	} else if err := file.Close(); err != nil {
+		return nil, err
+	} else if err := yaml.Unmarshal(data, &blackout); err != nil {
+		return nil, fmt.Errorf("Invalid %v: %v", BlackoutConfig, err)
+	}
+
+	for _, period := range blackout {
+		if !period.From.Before(period.To) {
+			return nil, fmt.Errorf("Invalid %v period %v: from must be before to", BlackoutConfig, period)
+		}
+	}
+
+	log.Printf("Load %v config with %d blackout periods", BlackoutConfig, len(blackout))
+
+	return blackout, nil
+}
+
+// returns the blackout period covering the given time, if any
+func (blackout Blackout) Check(t time.Time) (BlackoutPeriod, bool) {
+	for _, period := range blackout {
+		if period.Contains(t) {
+			return period, true
+		}
+	}
+
+	return BlackoutPeriod{}, false
+}
+
+// returns the next time not covered by any (overlapping) blackout periods
+func (blackout Blackout) NextAllowed(t time.Time) time.Time {
+	for {
+		if period, active := blackout.Check(t); !active {
+			return t
+		} else {
+			t = period.To
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DefaultHealthMargin = 15 * time.Minute
+const DefaultHealthRunTimeout = 6 * time.Hour
+
+// Liveness and readiness state, served at /healthz and /readyz on the --metrics-listen address
+type Health struct {
+	margin     time.Duration
+	runTimeout time.Duration // fallback for runs without a deadline
+
+	mutex       sync.Mutex
+	ready       bool
+	runStart    time.Time // zero if not running
+	runDeadline time.Time // zero if not running
+	nextRun     time.Time // zero if not scheduled
+}
+
+func makeHealth(options Options) *Health {
+	return &Health{
+		// the run also waits for any shutdown inhibitors, and for the host to shutdown after each reboot attempt
+		margin:     options.RebootInhibitTimeout + time.Duration(options.RebootAttempts+1)*options.RebootTimeout + options.HealthMargin,
+		runTimeout: options.HealthRunTimeout,
+	}
+}
+
+// mark startup recovery as complete
+func (health *Health) SetReady() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.ready = true
+}
+
+// track the current run, bounded by the context deadline
+func (health *Health) StartRun(ctx context.Context, startTime time.Time) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.runStart = startTime
+
+	if deadline, ok := ctx.Deadline(); ok {
+		health.runDeadline = deadline.Add(health.margin)
+	} else {
+		health.runDeadline = startTime.Add(health.runTimeout + health.margin)
+	}
+}
+
+func (health *Health) EndRun() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.runStart = time.Time{}
+	health.runDeadline = time.Time{}
+}
+
+// track the next scheduled run, updated by the scheduler each time the schedule fires, zero if not scheduled
+func (health *Health) SetNextRun(nextTime time.Time) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.nextRun = nextTime
+}
+
+// fails if the current run has exceeded its deadline, or the scheduler has stopped
+func (health *Health) checkLive() error {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	var now = time.Now()
+
+	if !health.runStart.IsZero() && now.After(health.runDeadline) {
+		return fmt.Errorf("Run started at %v has exceeded its deadline at %v", health.runStart, health.runDeadline)
+	} else if !health.runStart.IsZero() {
+		return nil
+	} else if !health.nextRun.IsZero() && now.After(health.nextRun.Add(health.margin)) {
+		return fmt.Errorf("Scheduled run at %v was not started", health.nextRun)
+	} else {
+		return nil
+	}
+}
+
+// fails until startup recovery is complete
+func (health *Health) checkReady() error {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if !health.ready {
+		return fmt.Errorf("Startup recovery is not complete")
+	} else {
+		return nil
+	}
+}
+
+func (health *Health) handler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			fmt.Fprintln(w, "ok")
+		}
+	})
+}
+
+func (health *Health) register(mux *http.ServeMux) {
+	mux.Handle("/healthz", health.handler(health.checkLive))
+	mux.Handle("/readyz", health.handler(health.checkReady))
+}
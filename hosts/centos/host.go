@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strconv"
 
 	"github.com/kontena/pharos-host-upgrades/hosts"
 	"github.com/kontena/pharos-host-upgrades/proc"
@@ -13,6 +14,8 @@ import (
 
 const OperatingSystem = "CentOS"
 
+// yum transaction summary
+var upgradePackagesRegexp = regexp.MustCompile(`(?m)^(?:Install|Upgrade)\s+(\d+) Packages?`)
 var osPrettyNameRegexp = regexp.MustCompile(`CentOS Linux (.+?)( \(.+?\))?`)
 
 const upgradeScript = `
@@ -23,12 +26,23 @@ yum-cron ${CONFIG_PATH:-} | tee $HOST_PATH/yum-cron.out
 needs-restarting -r > $HOST_PATH/needs-restarting.out || touch -a $HOST_PATH/needs-restarting.stamp
 `
 
+const statusScript = `
+set -ue
+
+if needs-restarting -r > $HOST_PATH/needs-restarting.out; then
+	rm -f $HOST_PATH/needs-restarting.stamp
+else
+	touch -a $HOST_PATH/needs-restarting.stamp
+fi
+`
+
 type Host struct {
 	info   hosts.Info
 	config hosts.Config
 
 	configPath string
 	scriptPath string
+	statusPath string
 }
 
 func (host *Host) Probe() (hosts.Info, bool) {
@@ -56,6 +70,14 @@ func (host *Host) Probe() (hosts.Info, bool) {
 			host.info.BootTime = procStat.BootTime
 		}
 
+		if bootID, err := proc.ReadBootID(); err != nil {
+			log.Printf("hosts/centos failed read BootID: %v", err)
+		} else {
+			log.Printf("hosts/centos boot id: %v", bootID)
+
+			host.info.BootID = bootID
+		}
+
 		log.Printf("hosts/centos probe success: %#v", host.info)
 
 		return host.info, true
@@ -95,6 +117,14 @@ func (host *Host) Config(config hosts.Config) error {
 		host.scriptPath = path
 	}
 
+	if path, err := config.WriteHostFile("host-status.sh", bytes.NewReader([]byte(statusScript)), hosts.FileModeScript); err != nil {
+		return err
+	} else {
+		log.Printf("hosts/centos: using generated host-status.sh at %v", path)
+
+		host.statusPath = path
+	}
+
 	return nil
 }
 
@@ -137,6 +167,12 @@ func (host *Host) readUpgradeLog(status *hosts.Status) error {
 		status.UpgradeLog = buf.String()
 	}
 
+	for _, match := range upgradePackagesRegexp.FindAllStringSubmatch(status.UpgradeLog, -1) {
+		if count, err := strconv.Atoi(match[1]); err == nil {
+			status.UpgradePackages += count
+		}
+	}
+
 	return nil
 }
 
@@ -161,6 +197,24 @@ func (host *Host) Upgrade() (hosts.Status, error) {
 	}
 }
 
+func (host *Host) Status() (hosts.Status, error) {
+	var status hosts.Status
+	var env = []string{
+		"HOST_PATH=" + host.config.HostPath(),
+	}
+	var cmd = []string{"/bin/sh", "-x", host.statusPath}
+
+	log.Printf("hosts/centos status...")
+
+	if err := host.exec(env, cmd); err != nil {
+		return status, err
+	} else if err := host.readNeedsRestarting(&status); err != nil {
+		return status, err
+	} else {
+		return status, nil
+	}
+}
+
 func (host *Host) Reboot() error {
 	log.Printf("hosts/centos reboot...")
 
@@ -11,19 +11,25 @@ type Info struct {
 	Kernel                 string
 	KernelRelease          string
 	BootTime               time.Time
+	BootID                 string // changes on each boot
 }
 
 type Status struct {
 	RebootRequired        bool
 	RebootRequiredSince   time.Time
 	RebootRequiredMessage string
+	RebootRequiredReason  string // optional kube condition reason, defaults to RebootRequired
 
-	UpgradeLog string
+	UpgradeLog      string
+	UpgradePackages int // number of packages upgraded, parsed from the UpgradeLog
 }
 
 type Host interface {
 	Probe() (Info, bool)
 	Config(Config) error
 	Upgrade() (Status, error)
+
+	// Query the current reboot status, without upgrading
+	Status() (Status, error)
 	Reboot() error
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
 
 	"github.com/kontena/pharos-host-upgrades/hosts"
 	"github.com/kontena/pharos-host-upgrades/proc"
@@ -13,6 +14,7 @@ import (
 
 const OperatingSystem = "Ubuntu"
 
+var upgradePackagesRegexp = regexp.MustCompile(`(?m)^Packages that will be upgraded: (.*)$`)
 var osPrettyNameRegexp = regexp.MustCompile(`Ubuntu (\S+)( LTS)?`)
 
 type aptConfVars struct {
@@ -42,6 +44,17 @@ fi
 # which needrestart && needrestart -b > $HOST_PATH/needrestart
 `
 
+const statusScript = `
+set -ue
+
+if [ -e /run/reboot-required ]; then
+	# preserve timestamp
+	cp -a /run/reboot-required $HOST_PATH/reboot-required
+else
+	rm -f $HOST_PATH/reboot-required
+fi
+`
+
 type Host struct {
 	info   hosts.Info
 	config hosts.Config
@@ -49,6 +62,7 @@ type Host struct {
 	configPath    string
 	aptConfigPath string
 	scriptPath    string
+	statusPath    string
 }
 
 func (host *Host) Probe() (hosts.Info, bool) {
@@ -76,6 +90,14 @@ func (host *Host) Probe() (hosts.Info, bool) {
 			host.info.BootTime = procStat.BootTime
 		}
 
+		if bootID, err := proc.ReadBootID(); err != nil {
+			log.Printf("hosts/ubuntu failed read BootID: %v", err)
+		} else {
+			log.Printf("hosts/ubuntu boot id: %v", bootID)
+
+			host.info.BootID = bootID
+		}
+
 		log.Printf("hosts/ubuntu probe success: %#v", host.info)
 
 		return host.info, true
@@ -124,6 +146,14 @@ func (host *Host) Config(config hosts.Config) error {
 		host.scriptPath = path
 	}
 
+	if path, err := config.WriteHostFile("host-status.sh", bytes.NewReader([]byte(statusScript))); err != nil {
+		return err
+	} else {
+		log.Printf("hosts/ubuntu: using generated host-status.sh at %v", path)
+
+		host.statusPath = path
+	}
+
 	return nil
 }
 
@@ -162,6 +192,10 @@ func (host *Host) readUpgradeLog(status *hosts.Status) error {
 		status.UpgradeLog = buf.String()
 	}
 
+	for _, match := range upgradePackagesRegexp.FindAllStringSubmatch(status.UpgradeLog, -1) {
+		status.UpgradePackages += len(strings.Fields(match[1]))
+	}
+
 	return nil
 }
 
@@ -186,6 +220,24 @@ func (host *Host) Upgrade() (hosts.Status, error) {
 	}
 }
 
+func (host *Host) Status() (hosts.Status, error) {
+	var status hosts.Status
+	var env = []string{
+		"HOST_PATH=" + host.config.HostPath(),
+	}
+	var cmd = []string{"/bin/sh", "-x", host.statusPath}
+
+	log.Printf("hosts/ubuntu status...")
+
+	if err := host.exec(env, cmd); err != nil {
+		return status, err
+	} else if err := host.readRebootRequired(&status); err != nil {
+		return status, err
+	} else {
+		return status, nil
+	}
+}
+
 func (host *Host) Reboot() error {
 	log.Printf("hosts/ubuntu reboot...")
 
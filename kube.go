@@ -7,17 +7,42 @@ import (
 	"log"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
 	"github.com/kontena/pharos-host-upgrades/hosts"
 	"github.com/kontena/pharos-host-upgrades/kube"
-	"github.com/kontena/pharos-host-upgrades/kubectl"
+	"github.com/kontena/pharos-host-upgrades/systemd"
 )
 
 const KubeLockAnnotation = "pharos-host-upgrades.kontena.io/lock"
+const KubeLockTokenAnnotation = "pharos-host-upgrades.kontena.io/lock-token"
+const KubeMaxConcurrentAnnotation = "pharos-host-upgrades.kontena.io/max-concurrent"
 const KubeDrainAnnotation = "pharos-host-upgrades.kontena.io/drain"
 const KubeRebootAnnotation = "pharos-host-upgrades.kontena.io/reboot"
+const KubeTriggerAnnotation = "pharos-host-upgrades.kontena.io/trigger"
+const KubePausedAnnotation = "pharos-host-upgrades.kontena.io/paused" // DaemonSet or node annotation, or node label
+const KubeScheduleAnnotation = "pharos-host-upgrades.kontena.io/schedule"
+const KubeScheduleWindowAnnotation = "pharos-host-upgrades.kontena.io/schedule-window"
+
+const KubeLockHoldersInterval = 1 * time.Minute
+
+const KubeLockBackendAnnotation = "annotation"
+const KubeLockBackendLease = "lease"
 
 type KubeOptions struct {
 	kube.Options
+
+	LockBackend   string
+	LeaseDuration time.Duration
+	MaxConcurrent string
+	TopologyKey   string
+	StaleTimeout  time.Duration
+
+	DrainOptions      kube.DrainOptions
+	DrainSkipSelector string
+	DrainWaitSelector string
 }
 
 func (options KubeOptions) IsSet() bool {
@@ -25,17 +50,30 @@ func (options KubeOptions) IsSet() bool {
 }
 
 type Kube struct {
-	options  kube.Options
-	hostInfo hosts.Info
-	kube     *kube.Kube
-	lock     *kube.Lock
-	node     *kube.Node
+	options      kube.Options
+	drainOptions kube.DrainOptions
+	hostInfo     hosts.Info
+	kube         *kube.Kube
+	lock         kube.Locker
+	node         *kube.Node
+	daemonSet    *kube.DaemonSet
+	events       *kube.Recorder
+}
+
+// returned by AcquireLock if upgrades are paused
+type PausedError struct {
+	Reason string
+}
+
+func (err PausedError) Error() string {
+	return err.Reason
 }
 
-func makeKube(options Options, hostInfo hosts.Info) (*Kube, error) {
+func makeKube(options Options, hostInfo hosts.Info, rebootState *RebootState) (*Kube, error) {
 	var k = Kube{
-		options:  options.Kube.Options,
-		hostInfo: hostInfo,
+		options:      options.Kube.Options,
+		drainOptions: options.Kube.DrainOptions,
+		hostInfo:     hostInfo,
 	}
 
 	if !options.Kube.IsSet() {
@@ -49,6 +87,10 @@ func makeKube(options Options, hostInfo hosts.Info) (*Kube, error) {
 		options.Kube.Node,
 	)
 
+	if err := k.initDrain(options.Kube); err != nil {
+		return nil, err
+	}
+
 	if kube, err := kube.New(options.Kube.Options); err != nil {
 		return nil, err
 	} else {
@@ -59,12 +101,20 @@ func makeKube(options Options, hostInfo hosts.Info) (*Kube, error) {
 		return nil, err
 	}
 
-	if err := k.initLock(); err != nil {
+	if err := k.initDaemonSet(); err != nil {
+		return nil, err
+	}
+
+	if err := k.initEvents(); err != nil {
+		return nil, err
+	}
+
+	if err := k.initLock(options.Kube); err != nil {
 		return nil, err
 	}
 
-	// verifies host <=> node state, fails if not rebooted
-	if err := k.clearNodeReboot(); err != nil {
+	// verifies host <=> node state, rolls back if not rebooted
+	if err := k.recoverNodeReboot(rebootState); err != nil {
 		return nil, err
 	}
 
@@ -81,6 +131,28 @@ func makeKube(options Options, hostInfo hosts.Info) (*Kube, error) {
 	return &k, nil
 }
 
+func (k *Kube) initDrain(options KubeOptions) error {
+	if options.DrainSkipSelector != "" {
+		selector, err := labels.Parse(options.DrainSkipSelector)
+		if err != nil {
+			return fmt.Errorf("Invalid --drain-skip-selector=%v: %v", options.DrainSkipSelector, err)
+		}
+
+		k.drainOptions.SkipSelector = selector
+	}
+
+	if options.DrainWaitSelector != "" {
+		selector, err := labels.Parse(options.DrainWaitSelector)
+		if err != nil {
+			return fmt.Errorf("Invalid --drain-wait-selector=%v: %v", options.DrainWaitSelector, err)
+		}
+
+		k.drainOptions.WaitSelector = selector
+	}
+
+	return nil
+}
+
 func (k *Kube) initNode() error {
 	if kubeNode, err := k.kube.Node(); err != nil {
 		return err
@@ -91,43 +163,153 @@ func (k *Kube) initNode() error {
 	return nil
 }
 
-func (k *Kube) initLock() error {
-	if kubeLock, err := k.kube.Lock(KubeLockAnnotation); err != nil {
+func (k *Kube) initDaemonSet() error {
+	if daemonSet, err := k.kube.DaemonSet(); err != nil {
 		return err
 	} else {
-		k.lock = kubeLock
+		k.daemonSet = daemonSet
 	}
 
 	return nil
 }
 
-func (k *Kube) checkReboot() (time.Time, bool, error) {
-	var t time.Time
+func (k *Kube) initEvents() error {
+	if recorder, err := k.kube.Recorder(); err != nil {
+		return fmt.Errorf("Failed to initialize kube event recorder: %v", err)
+	} else {
+		k.events = recorder
+	}
+
+	return nil
+}
+
+func (k *Kube) initLock(options KubeOptions) error {
+	var maxConcurrent = intstr.Parse(options.MaxConcurrent)
+
+	if _, err := intstr.GetValueFromIntOrPercent(&maxConcurrent, 100, false); err != nil {
+		return fmt.Errorf("Invalid --max-concurrent=%v: %v", options.MaxConcurrent, err)
+	}
+
+	switch options.LockBackend {
+	case KubeLockBackendAnnotation:
+		var lockOptions = kube.LockOptions{
+			Annotation:              KubeLockAnnotation,
+			TokenAnnotation:         KubeLockTokenAnnotation,
+			MaxConcurrent:           maxConcurrent,
+			MaxConcurrentAnnotation: KubeMaxConcurrentAnnotation,
+			TopologyKey:             options.TopologyKey,
+			Version:                 Version,
+			StaleTimeout:            options.StaleTimeout,
+		}
+
+		if options.TopologyKey != "" && maxConcurrent == intstr.FromInt(1) {
+			log.Printf("Using --lock-topology-key=%v with --max-concurrent=1 has no effect, unless overridden by the %v DaemonSet annotation", options.TopologyKey, KubeMaxConcurrentAnnotation)
+		}
+
+		if kubeLock, err := k.kube.Lock(lockOptions); err != nil {
+			return err
+		} else {
+			k.lock = kubeLock
+		}
+	case KubeLockBackendLease:
+		if maxConcurrent != intstr.FromInt(1) {
+			return fmt.Errorf("Invalid --max-concurrent=%v: not supported with --lock-backend=%v", options.MaxConcurrent, options.LockBackend)
+		} else if options.TopologyKey != "" {
+			return fmt.Errorf("Invalid --lock-topology-key=%v: not supported with --lock-backend=%v", options.TopologyKey, options.LockBackend)
+		}
+
+		if kubeLease, err := k.kube.Lease(options.LeaseDuration); err != nil {
+			return err
+		} else {
+			k.lock = kubeLease
+		}
+	default:
+		return fmt.Errorf("Invalid --lock-backend=%v", options.LockBackend)
+	}
+
+	log.Printf("Using --lock-backend=%v --max-concurrent=%v with kube lock %v", options.LockBackend, options.MaxConcurrent, k.lock)
+
+	return nil
+}
+
+// KubeRebootAnnotation value
+//
+// Older versions used a plain JSON timestamp, without the boot ID.
+type KubeReboot struct {
+	Time   time.Time   `json:"time"`
+	BootID string      `json:"bootID,omitempty"` // host boot ID before rebooting
+	Phase  RebootPhase `json:"phase,omitempty"`  // legacy annotations are rebooting
+}
+
+func (reboot *KubeReboot) UnmarshalJSON(data []byte) error {
+	type kubeReboot KubeReboot
+
+	if err := json.Unmarshal(data, &reboot.Time); err == nil {
+		return nil // legacy timestamp
+	} else {
+		return json.Unmarshal(data, (*kubeReboot)(reboot))
+	}
+}
+
+func (k *Kube) checkReboot() (KubeReboot, bool, error) {
+	var reboot KubeReboot
 
 	if value, exists, err := k.node.GetAnnotation(KubeRebootAnnotation); err != nil {
-		return t, false, fmt.Errorf("Faield to get node reboot annotation: %v", err)
+		return reboot, false, fmt.Errorf("Faield to get node reboot annotation: %v", err)
 	} else if !exists {
-		return t, false, nil
-	} else if err := json.Unmarshal([]byte(value), &t); err != nil {
-		return t, true, fmt.Errorf("Failed to unmarshal reboot annotation: %v", err)
+		return reboot, false, nil
+	} else if err := json.Unmarshal([]byte(value), &reboot); err != nil {
+		return reboot, true, fmt.Errorf("Failed to unmarshal reboot annotation: %v", err)
 	} else {
-		return t, true, nil
+		return reboot, true, nil
 	}
 }
 
-// check and clear node reboot state/status
-// fails if expected to reboot, but did not reboot
-func (k *Kube) clearNodeReboot() error {
-	if rebootTime, rebooting, err := k.checkReboot(); err != nil {
-		return err
+// compare boot IDs if known, falling back to the host mount reboot state, or comparing the boot time for legacy annotations
+func (k *Kube) testRebooted(reboot KubeReboot, rebootState *RebootState) (bool, string) {
+	if reboot.BootID != "" && k.hostInfo.BootID != "" {
+		if reboot.BootID == k.hostInfo.BootID {
+			return false, fmt.Sprintf("reboot boot_id=%v == boot_id=%v", reboot.BootID, k.hostInfo.BootID)
+		} else {
+			return true, fmt.Sprintf("reboot boot_id=%v != boot_id=%v", reboot.BootID, k.hostInfo.BootID)
+		}
+	}
+
+	if rebootState.Phase != RebootPhaseNone {
+		return false, fmt.Sprintf("host %v is still %v since %v", RebootStateFile, rebootState.Phase, rebootState.Time)
+	} else if !k.hostInfo.BootTime.After(reboot.Time) {
+		return false, fmt.Sprintf("reboot=%v >= boot=%v", reboot.Time, k.hostInfo.BootTime)
+	} else {
+		return true, fmt.Sprintf("reboot=%v < boot=%v", reboot.Time, k.hostInfo.BootTime)
+	}
+}
+
+// resume or roll back an interrupted reboot sequence, before clearing the node drain and lock
+func (k *Kube) recoverNodeReboot(rebootState *RebootState) error {
+	if reboot, rebooting, err := k.checkReboot(); err != nil {
+		log.Printf("Kube node %v has an invalid reboot annotation, rolling back: %v", k.node, err)
+
+		return k.RebootFailed(err)
+
+	} else if !rebooting && rebootState.Phase != RebootPhaseNone {
+		log.Printf("Kube node %v is missing the reboot annotation for the host %v phase=%v, rolling back", k.node, RebootStateFile, rebootState.Phase)
+
+		return k.RebootFailed(fmt.Errorf("Interrupted while %v", rebootState.Phase))
 
 	} else if !rebooting {
 		log.Printf("Initialized kube node %v (not rebooting)", k.node)
 
 		return nil
 
-	} else if !k.hostInfo.BootTime.After(rebootTime) {
-		return fmt.Errorf("Kube node %v is still rebooting (reboot=%v >= boot=%v)", k.node, rebootTime, k.hostInfo.BootTime)
+	} else if rebooted, reason := k.testRebooted(reboot, rebootState); !rebooted && reboot.Phase == RebootPhaseDraining {
+		log.Printf("Kube node %v was interrupted while draining (%v), rolling back", k.node, reason)
+
+		return k.RebootFailed(fmt.Errorf("Interrupted while draining for reboot at %v", reboot.Time))
+
+	} else if !rebooted {
+		log.Printf("Kube node %v was not rebooted (%v), rolling back", k.node, reason)
+
+		return k.RebootFailed(fmt.Errorf("Host was not rebooted after %v (%v)", reboot.Time, reason))
 
 	} else if err := k.node.SetCondition(MakeRebootConditionRebooted(k.hostInfo.BootTime)); err != nil {
 		log.Printf("Failed to update node %v condition: %v", k.node, err)
@@ -138,18 +320,20 @@ func (k *Kube) clearNodeReboot() error {
 		return fmt.Errorf("Failed to clear reboot annotation: %v", err)
 
 	} else {
-		log.Printf("Kube node %v was rebooted (reboot=%v < boot=%v)...", k.node, rebootTime, k.hostInfo.BootTime)
+		log.Printf("Kube node %v was rebooted (%v)...", k.node, reason)
+
+		k.events.NodeEventf(corev1.EventTypeNormal, "Rebooted", "Host was rebooted at %v", k.hostInfo.BootTime)
 
 		return nil
 	}
 }
 
-// uncordon if drained before reboot
 func (k *Kube) clearNodeDrain() error {
 	if changed, err := k.node.SetSchedulableIfAnnotated(KubeDrainAnnotation); err != nil {
 		return fmt.Errorf("Failed to clear node drain state: %v", err)
 	} else if changed {
 		log.Printf("Uncordoned drained kube node %v (with annotation %v)", k.node, KubeDrainAnnotation)
+		k.events.NodeEventf(corev1.EventTypeNormal, "Uncordoned", "Uncordoned drained node")
 		return nil
 	} else {
 		log.Printf("Kube node %v is not marked as drained (with annotation %v)", k.node, KubeDrainAnnotation)
@@ -167,31 +351,83 @@ func (k *Kube) clearLock() error {
 		return fmt.Errorf("Failed to release lock %v: %v", k.lock, err)
 	} else {
 		log.Printf("Released kube lock %v (value=%v)", k.lock, value)
+		k.events.DaemonSetEventf(corev1.EventTypeNormal, "LockReleased", "Node %v released lock %v", k.node, k.lock)
 	}
 
 	return nil
 }
 
+// check if upgrades are paused for the DaemonSet or node
+func (k *Kube) checkPaused() (string, bool, error) {
+	if value, exists, err := k.daemonSet.GetAnnotation(KubePausedAnnotation); err != nil {
+		return "", false, fmt.Errorf("Failed to get daemonset paused annotation: %v", err)
+	} else if exists {
+		return fmt.Sprintf("Upgrades are paused for DaemonSet %v (with annotation %v=%v)", k.daemonSet, KubePausedAnnotation, value), true, nil
+	}
+
+	if value, exists, err := k.node.GetAnnotation(KubePausedAnnotation); err != nil {
+		return "", false, fmt.Errorf("Failed to get node paused annotation: %v", err)
+	} else if exists {
+		return fmt.Sprintf("Upgrades are paused for node %v (with annotation %v=%v)", k.node, KubePausedAnnotation, value), true, nil
+	}
+
+	if value, exists, err := k.node.GetLabel(KubePausedAnnotation); err != nil {
+		return "", false, fmt.Errorf("Failed to get node paused label: %v", err)
+	} else if exists {
+		return fmt.Sprintf("Upgrades are paused for node %v (with label %v=%v)", k.node, KubePausedAnnotation, value), true, nil
+	}
+
+	return "", false, nil
+}
+
 // attempts to acquire the kube lock until the context expires
-func (k *Kube) AcquireLock(ctx context.Context) error {
+// fails with a PausedError if upgrades are paused, either before or after acquiring the lock
+//
+// Returns false without any error if not configured with a kube lock.
+func (k *Kube) AcquireLock(ctx context.Context) (bool, error) {
 	if k == nil || k.lock == nil {
 		log.Printf("Skip kube locking")
-		return nil
+		return false, nil
+	}
+
+	if reason, paused, err := k.checkPaused(); err != nil {
+		return false, err
+	} else if paused {
+		return false, PausedError{reason}
 	}
 
 	log.Printf("Acquiring kube lock...")
 
+	if value, acquired, err := k.lock.Test(); err != nil {
+		log.Printf("Failed to test kube lock %v: %v", k.lock, err)
+	} else if !acquired && value != "" {
+		k.events.DaemonSetEventf(corev1.EventTypeNormal, "LockWaiting", "Node %v waiting for lock %v (held by %v)", k.node, k.lock, value)
+	}
+
 	var wait = 1 * time.Second
 	var waitFactor = 2
 	var maxWait = 1 * time.Minute
 
 	for {
 		if err := ctx.Err(); err != nil {
-			return err
+			return false, err
 		} else if err := k.lock.Acquire(ctx); err != nil {
 			log.Printf("Acquiring kube lock failed, retrying: %v", err)
 		} else {
-			return nil
+			k.events.DaemonSetEventf(corev1.EventTypeNormal, "LockAcquired", "Node %v acquired lock %v", k.node, k.lock)
+
+			// may have been paused while waiting for the lock
+			if reason, paused, err := k.checkPaused(); err != nil {
+				return true, err
+			} else if paused {
+				if err := k.ReleaseLock(); err != nil {
+					return true, fmt.Errorf("Failed to release kube lock when paused: %v", err)
+				}
+
+				return false, PausedError{reason}
+			}
+
+			return true, nil
 		}
 
 		// don't hammer the API server too hard...
@@ -205,6 +441,35 @@ func (k *Kube) AcquireLock(ctx context.Context) error {
 	}
 }
 
+// poll the current kube lock holder nodes on each KubeLockHoldersInterval
+func (k *Kube) WatchLockHolders(update func(holders []string)) {
+	if k == nil || k.lock == nil {
+		log.Printf("Skip kube lock holders")
+		return
+	}
+
+	go func() {
+		for {
+			if holders, err := k.lock.Holders(); err != nil {
+				log.Printf("Failed to get kube lock %v holders: %v", k.lock, err)
+			} else {
+				update(holders)
+			}
+
+			time.Sleep(KubeLockHoldersInterval)
+		}
+	}()
+}
+
+// closed if the acquired kube lock is lost to another node, nil if not supported
+func (k *Kube) LockLost() <-chan struct{} {
+	if k == nil || k.lock == nil {
+		return nil
+	}
+
+	return k.lock.Lost()
+}
+
 func (k *Kube) ReleaseLock() error {
 	if k == nil || k.lock == nil {
 		log.Printf("Skip kube unlocking")
@@ -213,7 +478,160 @@ func (k *Kube) ReleaseLock() error {
 
 	log.Printf("Releasing kube lock...")
 
-	return k.lock.Release()
+	if err := k.lock.Release(); err != nil {
+		return err
+	}
+
+	k.events.DaemonSetEventf(corev1.EventTypeNormal, "LockReleased", "Node %v released lock %v", k.node, k.lock)
+
+	return nil
+}
+
+// watch for the node trigger annotation, clearing it once the triggered run has completed
+func (k *Kube) WatchTrigger(trigger func(done func(err error)) bool) {
+	if k == nil || k.node == nil {
+		log.Printf("Skip kube node trigger")
+		return
+	}
+
+	log.Printf("Watching kube node %v for trigger (with annotation %v)", k.node, KubeTriggerAnnotation)
+
+	go k.node.WatchAnnotation(nil, KubeTriggerAnnotation, func(value string) bool {
+		log.Printf("Kube node %v triggered upgrade (with annotation %v=%v)", k.node, KubeTriggerAnnotation, value)
+
+		if !trigger(func(err error) { k.completeTrigger(value, err) }) {
+			return false
+		}
+
+		k.events.NodeEventf(corev1.EventTypeNormal, "UpgradeTriggered", "Triggered upgrade (with annotation %v=%v)", KubeTriggerAnnotation, value)
+
+		return true
+	})
+}
+
+// record the result of the triggered run, and clear the trigger annotation unless changed
+func (k *Kube) completeTrigger(value string, err error) {
+	if err != nil {
+		k.events.NodeEventf(corev1.EventTypeWarning, "UpgradeTriggerFailed", "Triggered upgrade (with annotation %v=%v) failed: %v", KubeTriggerAnnotation, value, err)
+	} else {
+		k.events.NodeEventf(corev1.EventTypeNormal, "UpgradeTriggerCompleted", "Triggered upgrade (with annotation %v=%v) completed", KubeTriggerAnnotation, value)
+	}
+
+	if cleared, err := k.node.ClearAnnotationValue(KubeTriggerAnnotation, value); err != nil {
+		log.Printf("Failed to clear kube node %v trigger annotation %v: %v", k.node, KubeTriggerAnnotation, err)
+	} else if !cleared {
+		log.Printf("Kube node %v trigger annotation %v was changed during the triggered run, leaving it set", k.node, KubeTriggerAnnotation)
+	} else {
+		log.Printf("Cleared kube node %v trigger annotation %v=%v", k.node, KubeTriggerAnnotation, value)
+	}
+}
+
+// apply the node schedule annotations, falling back to the defaults if unset
+func (k *Kube) applySchedule(values map[string]string, schedule string, window time.Duration, update func(schedule string, window time.Duration) error) error {
+	if value, exists := values[KubeScheduleAnnotation]; exists {
+		schedule = value
+	}
+
+	if value, exists := values[KubeScheduleWindowAnnotation]; exists {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid annotation %v=%v: %v", KubeScheduleWindowAnnotation, value, err)
+		}
+
+		window = duration
+	}
+
+	return update(schedule, window)
+}
+
+// Update the schedule from the node annotations, and watch for changes
+//
+// The --schedule and --schedule-window are used for any unset annotations.
+func (k *Kube) WatchSchedule(schedule string, window time.Duration, update func(schedule string, window time.Duration) error) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip kube node schedule")
+		return nil
+	}
+
+	var annotations = []string{KubeScheduleAnnotation, KubeScheduleWindowAnnotation}
+
+	if values, err := k.node.GetAnnotations(annotations); err != nil {
+		return fmt.Errorf("Failed to get node schedule annotations: %v", err)
+	} else if err := k.applySchedule(values, schedule, window, update); err != nil {
+		log.Printf("Ignoring kube node %v schedule: %v", k.node, err)
+
+		k.events.NodeEventf(corev1.EventTypeWarning, "InvalidSchedule", "Ignoring invalid schedule: %v", err)
+	}
+
+	log.Printf("Watching kube node %v for schedule (with annotations %v, %v)", k.node, KubeScheduleAnnotation, KubeScheduleWindowAnnotation)
+
+	go k.node.WatchAnnotations(nil, annotations, func(values map[string]string) {
+		if err := k.applySchedule(values, schedule, window, update); err != nil {
+			log.Printf("Ignoring kube node %v schedule: %v", k.node, err)
+
+			k.events.NodeEventf(corev1.EventTypeWarning, "InvalidSchedule", "Ignoring invalid schedule: %v", err)
+		}
+	})
+
+	return nil
+}
+
+// update node status condition for a failed run attempt, with a zero retryTime if not retried
+func (k *Kube) UpdateFailedStatus(attempt int, attempts int, err error, retryTime time.Time) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip updating kube node condition")
+		return nil
+	}
+
+	log.Printf("Update kube node %v condition for failed attempt %d/%d: %v", k.node, attempt, attempts, err)
+
+	if retryTime.IsZero() {
+		k.events.NodeEventf(corev1.EventTypeWarning, "RunFailed", "Attempt %d/%d failed: %v", attempt, attempts, err)
+	} else {
+		k.events.NodeEventf(corev1.EventTypeWarning, "RunRetrying", "Attempt %d/%d failed, retrying at %v: %v", attempt, attempts, retryTime.Format(time.RFC3339), err)
+	}
+
+	if err := k.node.SetCondition(MakeUpgradeConditionFailed(attempt, attempts, err, retryTime)); err != nil {
+		log.Printf("Failed to update node %v condition: %v", k.node, err)
+	}
+
+	return nil
+}
+
+// update node status condition for a skipped run
+func (k *Kube) UpdatePausedStatus(reason string) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip updating kube node condition")
+		return nil
+	}
+
+	log.Printf("Update kube node %v condition for paused upgrades: %v", k.node, reason)
+
+	k.events.NodeEventf(corev1.EventTypeNormal, "UpgradePaused", "%v", reason)
+
+	if err := k.node.SetCondition(MakeUpgradeConditionPaused(reason)); err != nil {
+		log.Printf("Failed to update node %v condition: %v", k.node, err)
+	}
+
+	return nil
+}
+
+// record the start of the host upgrade
+func (k *Kube) StartUpgrade() {
+	if k == nil || k.events == nil {
+		return
+	}
+
+	k.events.NodeEventf(corev1.EventTypeNormal, "UpgradeStarted", "Upgrading host %v", k.hostInfo.OperatingSystem)
+}
+
+// record the lock holder phase, failures are only logged
+func (k *Kube) setLockPhase(phase kube.LockPhase) {
+	if k.lock == nil {
+		return
+	} else if err := k.lock.SetPhase(phase); err != nil {
+		log.Printf("Failed to set kube lock %v phase=%v: %v", k.lock, phase, err)
+	}
 }
 
 // Update node status condition based on function execution
@@ -225,6 +643,14 @@ func (k *Kube) UpdateHostStatus(status hosts.Status, upgradeErr error) error {
 
 	log.Printf("Update kube node %v condition for status=%v with error: %v", k.node, status, upgradeErr)
 
+	if upgradeErr != nil {
+		k.events.NodeEventf(corev1.EventTypeWarning, "UpgradeFailed", "Host upgrade failed: %v", upgradeErr)
+	} else if status.RebootRequired {
+		k.events.NodeEventf(corev1.EventTypeNormal, "UpgradeFinished", "Upgraded %d packages, reboot required", status.UpgradePackages)
+	} else {
+		k.events.NodeEventf(corev1.EventTypeNormal, "UpgradeFinished", "Upgraded %d packages", status.UpgradePackages)
+	}
+
 	if err := k.node.SetCondition(
 		MakeUpgradeCondition(status, upgradeErr),
 		MakeRebootCondition(k.hostInfo, status, upgradeErr),
@@ -235,37 +661,160 @@ func (k *Kube) UpdateHostStatus(status hosts.Status, upgradeErr error) error {
 	return nil
 }
 
-func (k *Kube) DrainNode() error {
+// update the node reboot condition for the current host status, without any upgrade
+func (k *Kube) UpdateRebootStatus(status hosts.Status) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip updating kube node reboot condition")
+		return nil
+	}
+
+	log.Printf("Update kube node %v reboot condition for status=%v", k.node, status)
+
+	if err := k.node.SetCondition(MakeRebootCondition(k.hostInfo, status, nil)); err != nil {
+		return fmt.Errorf("Failed to set node reboot condition: %v", err)
+	}
+
+	return nil
+}
+
+func (k *Kube) DrainNode(ctx context.Context) error {
 	if k == nil || k.node == nil {
 		return fmt.Errorf("No --kube-node configured")
 	}
 
 	log.Printf("Draining kube node %v (with annotation %v)...", k.node, KubeDrainAnnotation)
 
+	k.setLockPhase(kube.LockPhaseDraining)
+	k.events.NodeEventf(corev1.EventTypeNormal, "DrainStarted", "Draining node")
+
 	if err := k.node.SetAnnotation(KubeDrainAnnotation, "true"); err != nil {
 		return fmt.Errorf("Failed to set node annotation for drain: %v", err)
-	} else if err := kubectl.Drain(k.options.Node); err != nil {
-		return fmt.Errorf("Failed to drain node %v: %v", k.options.Node, err)
+	}
+
+	var startTime = time.Now()
+	var drained = 0
+
+	results, err := k.node.Drain(ctx, k.drainOptions)
+
+	for _, result := range results {
+		log.Printf("Drain kube node %v pod %v", k.node, result)
+
+		if result.Action != kube.DrainSkipped && result.Action != kube.DrainFailed {
+			drained++
+		}
+	}
+
+	if err != nil {
+		k.events.NodeEventf(corev1.EventTypeWarning, "DrainFailed", "Failed to drain node: %v", err)
+
+		return fmt.Errorf("Failed to drain node %v: %v", k.node, err)
+	}
+
+	k.events.NodeEventf(corev1.EventTypeNormal, "DrainFinished", "Drained %d pods in %v", drained, time.Since(startTime).Truncate(time.Second))
+
+	return nil
+}
+
+// uncordon after a failed drain
+func (k *Kube) UndrainNode() error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip kube node undrain")
+		return nil
+	}
+
+	log.Printf("Undraining kube node %v (with annotation %v)...", k.node, KubeDrainAnnotation)
+
+	return k.clearNodeDrain()
+}
+
+func (k *Kube) WarnRebootOverdue(pending time.Duration, maxPending time.Duration) {
+	if k == nil || k.node == nil {
+		return
+	}
+
+	k.events.NodeEventf(corev1.EventTypeWarning, "RebootOverdue", "Reboot required for %v, exceeding the maximum of %v, forcing reboot", pending.Round(time.Second), maxPending)
+}
+
+func (k *Kube) MarkRebootPending(status hosts.Status, rebootTime time.Time) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip kube node reboot pending")
+		return nil
+	}
+
+	log.Printf("Update kube node %v condition for reboot pending until %v", k.node, rebootTime)
+
+	if err := k.node.SetCondition(MakeRebootConditionPending(status, rebootTime)); err != nil {
+		return fmt.Errorf("Failed to set node condition for pending reboot: %v", err)
 	} else {
+		k.events.NodeEventf(corev1.EventTypeNormal, "RebootPending", "Reboot required, scheduled at %v", rebootTime.Format(time.RFC3339))
+
 		return nil
 	}
 }
 
-func (k *Kube) MarkReboot(rebootTime time.Time) error {
+func (k *Kube) MarkRebootInhibited(inhibitors []systemd.Inhibitor, inhibitTime time.Time, deadline time.Time) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip kube node reboot inhibited")
+		return nil
+	}
+
+	log.Printf("Update kube node %v condition for reboot inhibited until %v", k.node, deadline)
+
+	if err := k.node.SetCondition(MakeRebootConditionInhibited(inhibitors, inhibitTime, deadline)); err != nil {
+		return fmt.Errorf("Failed to set node condition for inhibited reboot: %v", err)
+	} else {
+		k.events.NodeEventf(corev1.EventTypeNormal, "RebootInhibited", "Reboot inhibited by %d host shutdown inhibitor locks", len(inhibitors))
+
+		return nil
+	}
+}
+
+// persist the reboot sequence phase in the node annotation
+func (k *Kube) MarkReboot(phase RebootPhase, rebootTime time.Time) error {
 	if k == nil || k.node == nil {
 		log.Printf("Skip kube node reboot marking")
 		return nil
 	}
 
-	log.Printf("Marking kube node %v for reboot (with annotation %v=%v)...", k.node, KubeRebootAnnotation, rebootTime)
+	log.Printf("Marking kube node %v for reboot %v (with annotation %v=%v)...", k.node, phase, KubeRebootAnnotation, rebootTime)
+
+	if phase == RebootPhaseRebooting {
+		k.setLockPhase(kube.LockPhaseRebooting)
+	}
 
-	if value, err := json.Marshal(rebootTime); err != nil {
+	if value, err := json.Marshal(KubeReboot{Time: rebootTime, BootID: k.hostInfo.BootID, Phase: phase}); err != nil {
 		return fmt.Errorf("Failed to marshal reboot annotation: %v", err)
 	} else if err := k.node.SetAnnotation(KubeRebootAnnotation, string(value)); err != nil {
 		return fmt.Errorf("Failed to set node annotation for reboot: %v", err)
+	} else if phase != RebootPhaseRebooting {
+		return nil
 	} else if err := k.node.SetCondition(MakeRebootConditionRebooting(rebootTime)); err != nil {
 		return fmt.Errorf("Failed to set node condition for reboot: %v", err)
 	} else {
+		k.events.NodeEventf(corev1.EventTypeNormal, "Rebooting", "Rebooting host")
+
+		return nil
+	}
+}
+
+// roll back the reboot sequence, the node must still be undrained and the lock released
+func (k *Kube) RebootFailed(rebootErr error) error {
+	if k == nil || k.node == nil {
+		log.Printf("Skip kube node reboot failure")
 		return nil
 	}
+
+	log.Printf("Update kube node %v condition for failed reboot: %v", k.node, rebootErr)
+
+	k.events.NodeEventf(corev1.EventTypeWarning, "RebootFailed", "Host reboot failed: %v", rebootErr)
+
+	if err := k.node.SetCondition(MakeRebootConditionFailed(rebootErr)); err != nil {
+		log.Printf("Failed to update node %v condition: %v", k.node, err)
+	}
+
+	if err := k.node.ClearAnnotation(KubeRebootAnnotation); err != nil {
+		return fmt.Errorf("Failed to clear reboot annotation: %v", err)
+	}
+
+	return nil
 }
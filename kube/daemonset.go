@@ -0,0 +1,48 @@
+package kube
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	"k8s.io/client-go/rest"
+)
+
+type DaemonSet struct {
+	client    appsv1client.AppsV1Interface
+	namespace string
+	name      string
+}
+
+func (ds *DaemonSet) String() string {
+	return fmt.Sprintf("%v/%v", ds.namespace, ds.name)
+}
+
+func (ds *DaemonSet) connect(config *rest.Config) error {
+	if client, err := appsv1client.NewForConfig(config); err != nil {
+		return err
+	} else {
+		ds.client = client
+	}
+
+	return nil
+}
+
+func (ds *DaemonSet) get() (*appsv1.DaemonSet, error) {
+	if obj, err := ds.client.DaemonSets(ds.namespace).Get(ds.name, metav1.GetOptions{}); err != nil {
+		return nil, fmt.Errorf("Get %v: %v", ds, err)
+	} else {
+		return obj, nil
+	}
+}
+
+func (ds *DaemonSet) GetAnnotation(annotation string) (string, bool, error) {
+	if obj, err := ds.get(); err != nil {
+		return "", false, err
+	} else if value, exists := obj.ObjectMeta.Annotations[annotation]; !exists {
+		return "", false, nil
+	} else {
+		return value, true, nil
+	}
+}
@@ -0,0 +1,318 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const DefaultDrainTimeout = 10 * time.Minute
+const DefaultDrainPodTimeout = 5 * time.Minute
+
+const drainMirrorAnnotation = "kubernetes.io/config.mirror"
+
+// retry interval for evictions rejected by a PodDisruptionBudget
+var drainRetryInterval = 5 * time.Second
+
+// poll interval when waiting for evicted pods to be deleted
+var drainPollInterval = 1 * time.Second
+
+type DrainOptions struct {
+	GracePeriod     time.Duration   // pod termination grace period, negative to use the pod default
+	Timeout         time.Duration   // overall timeout for the drain, zero for none
+	PodTimeout      time.Duration   // timeout for each pod eviction or deletion, zero for none
+	DeleteLocalData bool            // evict pods using emptyDir volumes
+	Force           bool            // delete pods not managed by a controller
+	SkipSelector    labels.Selector // leave matching pods in place, nil for none
+	WaitSelector    labels.Selector // wait for matching pods to terminate without evicting them, nil for none
+}
+
+type DrainAction string
+
+const (
+	DrainSkipped DrainAction = "skipped"
+	DrainEvicted DrainAction = "evicted"
+	DrainDeleted DrainAction = "deleted"
+	DrainWaited  DrainAction = "waited"
+	DrainFailed  DrainAction = "failed"
+)
+
+// Per-pod drain result
+type DrainResult struct {
+	Namespace string
+	Name      string
+	Action    DrainAction
+	Reason    string
+	Duration  time.Duration
+	Error     error
+}
+
+func (result DrainResult) String() string {
+	switch result.Action {
+	case DrainSkipped:
+		return fmt.Sprintf("%v/%v: %v (%v)", result.Namespace, result.Name, result.Action, result.Reason)
+	case DrainFailed:
+		return fmt.Sprintf("%v/%v: %v after %v: %v", result.Namespace, result.Name, result.Action, result.Duration, result.Error)
+	default:
+		return fmt.Sprintf("%v/%v: %v in %v", result.Namespace, result.Name, result.Action, result.Duration)
+	}
+}
+
+func (node *Node) listPods() ([]corev1.Pod, error) {
+	var listOptions = metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.name).String(),
+	}
+	var pods []corev1.Pod
+
+	if podList, err := node.client.Pods(metav1.NamespaceAll).List(listOptions); err != nil {
+		return nil, fmt.Errorf("List pods: %v", err)
+	} else {
+		for _, pod := range podList.Items {
+			if pod.Spec.NodeName == node.name {
+				pods = append(pods, pod)
+			}
+		}
+	}
+
+	return pods, nil
+}
+
+// test if pod should be left in place when draining
+func (node *Node) drainSkip(pod corev1.Pod, options DrainOptions) (bool, string) {
+	if _, exists := pod.ObjectMeta.Annotations[drainMirrorAnnotation]; exists {
+		return true, "mirror pod"
+	} else if controllerRef := metav1.GetControllerOf(&pod); controllerRef != nil && controllerRef.Kind == "DaemonSet" {
+		return true, fmt.Sprintf("managed by DaemonSet %v", controllerRef.Name)
+	} else if options.SkipSelector != nil && options.SkipSelector.Matches(labels.Set(pod.Labels)) {
+		return true, fmt.Sprintf("matches skip selector %v", options.SkipSelector)
+	} else {
+		return false, ""
+	}
+}
+
+// test if pod must be deleted instead of evicted
+func (node *Node) drainDelete(pod corev1.Pod) bool {
+	return metav1.GetControllerOf(&pod) == nil
+}
+
+// test if pod should be waited on instead of evicted
+func (node *Node) drainWait(pod corev1.Pod, options DrainOptions) bool {
+	return options.WaitSelector != nil && options.WaitSelector.Matches(labels.Set(pod.Labels))
+}
+
+// check if pod is allowed to be drained
+func (node *Node) drainCheck(pod corev1.Pod, options DrainOptions) error {
+	if node.drainDelete(pod) && !options.Force {
+		return fmt.Errorf("%v/%v: not managed by a controller", pod.Namespace, pod.Name)
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil && !options.DeleteLocalData {
+			return fmt.Errorf("%v/%v: uses emptyDir volume %v", pod.Namespace, pod.Name, volume.Name)
+		}
+	}
+
+	return nil
+}
+
+func (node *Node) deleteOptions(options DrainOptions) *metav1.DeleteOptions {
+	var deleteOptions metav1.DeleteOptions
+
+	if options.GracePeriod >= 0 {
+		var gracePeriodSeconds = int64(options.GracePeriod.Seconds())
+
+		deleteOptions.GracePeriodSeconds = &gracePeriodSeconds
+	}
+
+	return &deleteOptions
+}
+
+// evict pod, retrying while blocked by a PodDisruptionBudget
+func (node *Node) evictPod(ctx context.Context, pod corev1.Pod, options DrainOptions) error {
+	var eviction = policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+		},
+		DeleteOptions: node.deleteOptions(options),
+	}
+
+	for {
+		if err := node.client.Pods(pod.Namespace).Evict(&eviction); err == nil {
+			return nil
+		} else if errors.IsNotFound(err) {
+			return nil
+		} else if errors.IsTooManyRequests(err) {
+			log.Printf("kube/drain %v: retry eviction of pod %v/%v: %v", node, pod.Namespace, pod.Name, err)
+		} else {
+			return fmt.Errorf("Evict: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Evict: blocked by PodDisruptionBudget: %v", ctx.Err())
+		case <-time.After(drainRetryInterval):
+		}
+	}
+}
+
+// delete pod without respecting any PodDisruptionBudget
+func (node *Node) deletePod(pod corev1.Pod, options DrainOptions) error {
+	if err := node.client.Pods(pod.Namespace).Delete(pod.Name, node.deleteOptions(options)); err == nil {
+		return nil
+	} else if errors.IsNotFound(err) {
+		return nil
+	} else {
+		return fmt.Errorf("Delete: %v", err)
+	}
+}
+
+// wait for pod to be deleted or terminated
+func (node *Node) waitPod(ctx context.Context, pod corev1.Pod) error {
+	for {
+		if obj, err := node.client.Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{}); err != nil && errors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Get: %v", err)
+		} else if obj.UID != pod.UID {
+			return nil
+		} else if obj.Status.Phase == corev1.PodSucceeded || obj.Status.Phase == corev1.PodFailed {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Wait for pod termination: %v", ctx.Err())
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+func (node *Node) drainPod(ctx context.Context, pod corev1.Pod, options DrainOptions) DrainResult {
+	var result = DrainResult{
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+	}
+	var startTime = time.Now()
+
+	// waited pods are only bounded by the overall drain timeout
+	if options.PodTimeout != 0 && !node.drainWait(pod, options) {
+		timeoutCtx, cancel := context.WithTimeout(ctx, options.PodTimeout)
+		defer cancel()
+
+		ctx = timeoutCtx
+	}
+
+	if node.drainWait(pod, options) {
+		result.Action = DrainWaited
+	} else if node.drainDelete(pod) {
+		result.Action = DrainDeleted
+		result.Error = node.deletePod(pod, options)
+	} else {
+		result.Action = DrainEvicted
+		result.Error = node.evictPod(ctx, pod, options)
+	}
+
+	if result.Error == nil {
+		result.Error = node.waitPod(ctx, pod)
+	}
+
+	if result.Error != nil {
+		result.Action = DrainFailed
+	}
+
+	result.Duration = time.Since(startTime)
+
+	return result
+}
+
+// Cordon the node and evict all pods, except for DaemonSet, mirror and skipped pods
+//
+// Fails without evicting any pods if the options do not allow draining all of the pods.
+// Returns the per-pod results, with an error if any pods failed to evict.
+func (node *Node) Drain(ctx context.Context, options DrainOptions) ([]DrainResult, error) {
+	if options.Timeout != 0 {
+		timeoutCtx, cancel := context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+
+		ctx = timeoutCtx
+	}
+
+	log.Printf("kube/drain %v: cordon", node)
+
+	if err := node.SetUnschedulable(true); err != nil {
+		return nil, fmt.Errorf("Cordon %v: %v", node, err)
+	}
+
+	pods, err := node.listPods()
+	if err != nil {
+		return nil, err
+	}
+
+	var checkErrors []string
+
+	for _, pod := range pods {
+		if skip, _ := node.drainSkip(pod, options); skip {
+			continue
+		} else if node.drainWait(pod, options) {
+			continue
+		} else if err := node.drainCheck(pod, options); err != nil {
+			checkErrors = append(checkErrors, err.Error())
+		}
+	}
+
+	if len(checkErrors) > 0 {
+		return nil, fmt.Errorf("Unable to drain pods: %v", strings.Join(checkErrors, ", "))
+	}
+
+	var results = make([]DrainResult, len(pods))
+	var wg sync.WaitGroup
+
+	for i, pod := range pods {
+		if skip, reason := node.drainSkip(pod, options); skip {
+			results[i] = DrainResult{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				Action:    DrainSkipped,
+				Reason:    reason,
+			}
+
+			continue
+		}
+
+		log.Printf("kube/drain %v: drain pod %v/%v", node, pod.Namespace, pod.Name)
+
+		wg.Add(1)
+		go func(i int, pod corev1.Pod) {
+			defer wg.Done()
+
+			results[i] = node.drainPod(ctx, pod, options)
+		}(i, pod)
+	}
+
+	wg.Wait()
+
+	var failed []string
+
+	for _, result := range results {
+		if result.Action == DrainFailed {
+			failed = append(failed, fmt.Sprintf("%v/%v", result.Namespace, result.Name))
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("Failed to drain %d pods: %v", len(failed), strings.Join(failed, ", "))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,239 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testPodsResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+func init() {
+	drainRetryInterval = 10 * time.Millisecond
+	drainPollInterval = 10 * time.Millisecond
+}
+
+func makeTestNode(objects ...runtime.Object) (*Node, testClient) {
+	var client = makeTestClient(append([]runtime.Object{&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "test"}}}, objects...)...)
+
+	return &Node{client: client.CoreV1(), name: "test"}, client
+}
+
+func makeTestPod(namespace string, name string, nodeName string) *corev1.Pod {
+	var controller = true
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID("uid-" + name),
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: name, Controller: &controller},
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: nodeName,
+		},
+	}
+}
+
+// handle pod evictions by deleting the pod, or failing with the given error
+func reactEviction(client testClient, fn func(eviction *policyv1beta1.Eviction) error) {
+	client.PrependReactor("*", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+
+		var eviction = action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+
+		if err := fn(eviction); err != nil {
+			return true, nil, err
+		} else if err := client.tracker.Delete(testPodsResource, eviction.Namespace, eviction.Name); err != nil {
+			return true, nil, err
+		} else {
+			return true, nil, nil
+		}
+	})
+}
+
+func findResult(results []DrainResult, name string) (DrainResult, bool) {
+	for _, result := range results {
+		if result.Name == name {
+			return result, true
+		}
+	}
+
+	return DrainResult{}, false
+}
+
+func TestDrain(t *testing.T) {
+	var daemonSetPod = makeTestPod("kube-system", "daemonset-pod", "test")
+	var mirrorPod = makeTestPod("kube-system", "mirror-pod", "test")
+	var otherPod = makeTestPod("default", "other-pod", "other")
+
+	daemonSetPod.OwnerReferences[0].Kind = "DaemonSet"
+	mirrorPod.OwnerReferences = nil
+	mirrorPod.Annotations = map[string]string{drainMirrorAnnotation: "test"}
+
+	node, client := makeTestNode(
+		makeTestPod("default", "test-pod", "test"),
+		daemonSetPod,
+		mirrorPod,
+		otherPod,
+	)
+
+	reactEviction(client, func(eviction *policyv1beta1.Eviction) error {
+		return nil
+	})
+
+	results, err := node.Drain(context.Background(), DrainOptions{})
+
+	assert.NoErrorf(t, err, "Drain")
+	assert.Len(t, results, 3)
+
+	if result, ok := findResult(results, "test-pod"); assert.True(t, ok, "test-pod result") {
+		assert.Equal(t, DrainEvicted, result.Action)
+	}
+	if result, ok := findResult(results, "daemonset-pod"); assert.True(t, ok, "daemonset-pod result") {
+		assert.Equal(t, DrainSkipped, result.Action)
+	}
+	if result, ok := findResult(results, "mirror-pod"); assert.True(t, ok, "mirror-pod result") {
+		assert.Equal(t, DrainSkipped, result.Action)
+	}
+
+	if obj, err := client.CoreV1().Nodes().Get("test", metav1.GetOptions{}); assert.NoError(t, err) {
+		assert.True(t, obj.Spec.Unschedulable, "node is cordoned")
+	}
+
+	_, err = client.CoreV1().Pods("default").Get("other-pod", metav1.GetOptions{})
+	assert.NoError(t, err, "other node pod is not evicted")
+}
+
+func TestDrainRetryDisruptionBudget(t *testing.T) {
+	var attempts = 0
+
+	node, client := makeTestNode(makeTestPod("default", "test-pod", "test"))
+
+	reactEviction(client, func(eviction *policyv1beta1.Eviction) error {
+		if attempts++; attempts < 3 {
+			return errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+
+		return nil
+	})
+
+	results, err := node.Drain(context.Background(), DrainOptions{})
+
+	assert.NoErrorf(t, err, "Drain")
+	assert.Equal(t, 3, attempts)
+
+	if result, ok := findResult(results, "test-pod"); assert.True(t, ok, "test-pod result") {
+		assert.Equal(t, DrainEvicted, result.Action)
+	}
+}
+
+func TestDrainPodTimeout(t *testing.T) {
+	node, client := makeTestNode(makeTestPod("default", "test-pod", "test"))
+
+	reactEviction(client, func(eviction *policyv1beta1.Eviction) error {
+		return errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	})
+
+	results, err := node.Drain(context.Background(), DrainOptions{PodTimeout: 50 * time.Millisecond})
+
+	assert.EqualError(t, err, "Failed to drain 1 pods: default/test-pod")
+
+	if result, ok := findResult(results, "test-pod"); assert.True(t, ok, "test-pod result") {
+		assert.Equal(t, DrainFailed, result.Action)
+		assert.Error(t, result.Error)
+	}
+}
+
+func TestDrainCheck(t *testing.T) {
+	var unmanagedPod = makeTestPod("default", "unmanaged-pod", "test")
+	var localDataPod = makeTestPod("default", "local-data-pod", "test")
+
+	unmanagedPod.OwnerReferences = nil
+	localDataPod.Spec.Volumes = []corev1.Volume{
+		{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	}
+
+	node, client := makeTestNode(unmanagedPod, localDataPod)
+
+	reactEviction(client, func(eviction *policyv1beta1.Eviction) error {
+		t.Errorf("Unexpected eviction of %v/%v", eviction.Namespace, eviction.Name)
+
+		return nil
+	})
+
+	results, err := node.Drain(context.Background(), DrainOptions{})
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "default/unmanaged-pod: not managed by a controller")
+		assert.Contains(t, err.Error(), "default/local-data-pod: uses emptyDir volume data")
+	}
+	assert.Empty(t, results)
+}
+
+func TestDrainOptions(t *testing.T) {
+	var unmanagedPod = makeTestPod("default", "unmanaged-pod", "test")
+	var localDataPod = makeTestPod("default", "local-data-pod", "test")
+	var skipPod = makeTestPod("default", "skip-pod", "test")
+	var waitPod = makeTestPod("default", "wait-pod", "test")
+
+	unmanagedPod.OwnerReferences = nil
+	localDataPod.Spec.Volumes = []corev1.Volume{
+		{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	}
+	skipPod.Labels = map[string]string{"drain": "skip"}
+	waitPod.Labels = map[string]string{"drain": "wait"}
+	waitPod.Status.Phase = corev1.PodSucceeded
+
+	node, client := makeTestNode(unmanagedPod, localDataPod, skipPod, waitPod)
+
+	reactEviction(client, func(eviction *policyv1beta1.Eviction) error {
+		if eviction.Name == "local-data-pod" {
+			return nil
+		} else {
+			return fmt.Errorf("Unexpected eviction of %v/%v", eviction.Namespace, eviction.Name)
+		}
+	})
+
+	results, err := node.Drain(context.Background(), DrainOptions{
+		GracePeriod:     -1,
+		DeleteLocalData: true,
+		Force:           true,
+		SkipSelector:    labels.SelectorFromSet(labels.Set{"drain": "skip"}),
+		WaitSelector:    labels.SelectorFromSet(labels.Set{"drain": "wait"}),
+	})
+
+	assert.NoErrorf(t, err, "Drain")
+
+	if result, ok := findResult(results, "unmanaged-pod"); assert.True(t, ok, "unmanaged-pod result") {
+		assert.Equal(t, DrainDeleted, result.Action)
+	}
+	if result, ok := findResult(results, "local-data-pod"); assert.True(t, ok, "local-data-pod result") {
+		assert.Equal(t, DrainEvicted, result.Action)
+	}
+	if result, ok := findResult(results, "skip-pod"); assert.True(t, ok, "skip-pod result") {
+		assert.Equal(t, DrainSkipped, result.Action)
+	}
+	if result, ok := findResult(results, "wait-pod"); assert.True(t, ok, "wait-pod result") {
+		assert.Equal(t, DrainWaited, result.Action)
+	}
+
+	_, err = client.CoreV1().Pods("default").Get("unmanaged-pod", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err), "unmanaged pod is deleted")
+}
@@ -0,0 +1,107 @@
+package kube
+
+import (
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const EventSourceComponent = "pharos-host-upgrades"
+
+func makeEventSource(node string) corev1.EventSource {
+	return corev1.EventSource{Component: EventSourceComponent, Host: node}
+}
+
+// create a kube Event for the referenced object
+func createEvent(client corev1client.CoreV1Interface, namespace string, ref corev1.ObjectReference, source corev1.EventSource, eventType string, reason string, message string) error {
+	var now = metav1.Now()
+	var event = corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        message,
+		Source:         source,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+
+	if _, err := client.Events(namespace).Create(&event); err != nil {
+		return fmt.Errorf("Create event: %v", err)
+	}
+
+	return nil
+}
+
+// Record kube Events for the node and DaemonSet
+//
+// Events are best-effort, and failures are only logged.
+type Recorder struct {
+	client       corev1client.CoreV1Interface
+	appsClient   appsv1client.AppsV1Interface
+	namespace    string
+	source       corev1.EventSource
+	nodeRef      corev1.ObjectReference
+	daemonSetRef corev1.ObjectReference
+}
+
+func (recorder *Recorder) connect(config *rest.Config) error {
+	if client, err := corev1client.NewForConfig(config); err != nil {
+		return err
+	} else {
+		recorder.client = client
+	}
+
+	if client, err := appsv1client.NewForConfig(config); err != nil {
+		return err
+	} else {
+		recorder.appsClient = client
+	}
+
+	return nil
+}
+
+// resolve the node and DaemonSet UIDs for the event references
+func (recorder *Recorder) init() error {
+	if obj, err := recorder.client.Nodes().Get(recorder.nodeRef.Name, metav1.GetOptions{}); err != nil {
+		return fmt.Errorf("Get node %v: %v", recorder.nodeRef.Name, err)
+	} else {
+		recorder.nodeRef.UID = obj.UID
+	}
+
+	if obj, err := recorder.appsClient.DaemonSets(recorder.namespace).Get(recorder.daemonSetRef.Name, metav1.GetOptions{}); err != nil {
+		return fmt.Errorf("Get daemonset %v/%v: %v", recorder.namespace, recorder.daemonSetRef.Name, err)
+	} else {
+		recorder.daemonSetRef.UID = obj.UID
+	}
+
+	return nil
+}
+
+func (recorder *Recorder) record(namespace string, ref corev1.ObjectReference, eventType string, reason string, message string) {
+	log.Printf("kube/events %v/%v: %v %v: %v", ref.Kind, ref.Name, eventType, reason, message)
+
+	if err := createEvent(recorder.client, namespace, ref, recorder.source, eventType, reason, message); err != nil {
+		log.Printf("kube/events %v/%v: failed to record %v event: %v", ref.Kind, ref.Name, reason, err)
+	}
+}
+
+// Record a Normal or Warning event for the node
+func (recorder *Recorder) NodeEventf(eventType string, reason string, format string, args ...interface{}) {
+	// node events are recorded in the default namespace, like kubelet
+	recorder.record(metav1.NamespaceDefault, recorder.nodeRef, eventType, reason, fmt.Sprintf(format, args...))
+}
+
+// Record a Normal or Warning event for the DaemonSet
+func (recorder *Recorder) DaemonSetEventf(eventType string, reason string, format string, args ...interface{}) {
+	recorder.record(recorder.namespace, recorder.daemonSetRef, eventType, reason, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,49 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRecorder(t *testing.T) {
+	var node = makeTestNodeObject("test", corev1.ConditionTrue)
+	var ds = makeTestDaemonSet(3, nil)
+
+	node.UID = types.UID("node-uid")
+	ds.UID = types.UID("ds-uid")
+
+	var client = makeTestClient(node, ds)
+	var recorder = Recorder{
+		client:       client.CoreV1(),
+		appsClient:   client.AppsV1(),
+		namespace:    "kube-system",
+		source:       makeEventSource("test"),
+		nodeRef:      corev1.ObjectReference{Kind: "Node", Name: "test"},
+		daemonSetRef: corev1.ObjectReference{Kind: "DaemonSet", Namespace: "kube-system", Name: "host-upgrades"},
+	}
+
+	assert.NoError(t, recorder.init(), "init")
+
+	recorder.NodeEventf(corev1.EventTypeNormal, "UpgradeFinished", "Upgraded %d packages", 3)
+	recorder.DaemonSetEventf(corev1.EventTypeNormal, "LockAcquired", "Node %v acquired lock", "test")
+
+	if events, err := client.CoreV1().Events(metav1.NamespaceDefault).List(metav1.ListOptions{}); assert.NoError(t, err) && assert.Len(t, events.Items, 1) {
+		var event = events.Items[0]
+
+		assert.Equal(t, "UpgradeFinished", event.Reason)
+		assert.Equal(t, "Upgraded 3 packages", event.Message)
+		assert.Equal(t, types.UID("node-uid"), event.InvolvedObject.UID)
+		assert.Equal(t, "test", event.Source.Host)
+	}
+
+	if events, err := client.CoreV1().Events("kube-system").List(metav1.ListOptions{}); assert.NoError(t, err) && assert.Len(t, events.Items, 1) {
+		var event = events.Items[0]
+
+		assert.Equal(t, "LockAcquired", event.Reason)
+		assert.Equal(t, types.UID("ds-uid"), event.InvolvedObject.UID)
+	}
+}
@@ -2,7 +2,9 @@ package kube
 
 import (
 	"fmt"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -10,6 +12,7 @@ type Options struct {
 	Namespace string
 	DaemonSet string
 	Node      string
+	Pod       string
 }
 
 type Kube struct {
@@ -43,12 +46,52 @@ func (kube *Kube) Node() (*Node, error) {
 	return &node, nil
 }
 
-func (kube *Kube) Lock(annotation string) (*Lock, error) {
+func (kube *Kube) DaemonSet() (*DaemonSet, error) {
+	var ds = DaemonSet{
+		namespace: kube.options.Namespace,
+		name:      kube.options.DaemonSet,
+	}
+
+	if err := ds.connect(kube.config); err != nil {
+		return nil, err
+	}
+
+	return &ds, nil
+}
+
+func (kube *Kube) Recorder() (*Recorder, error) {
+	var recorder = Recorder{
+		namespace: kube.options.Namespace,
+		source:    makeEventSource(kube.options.Node),
+		nodeRef: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       kube.options.Node,
+		},
+		daemonSetRef: corev1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       "DaemonSet",
+			Namespace:  kube.options.Namespace,
+			Name:       kube.options.DaemonSet,
+		},
+	}
+
+	if err := recorder.connect(kube.config); err != nil {
+		return nil, err
+	} else if err := recorder.init(); err != nil {
+		return nil, err
+	}
+
+	return &recorder, nil
+}
+
+func (kube *Kube) Lock(options LockOptions) (*Lock, error) {
 	var lock = Lock{
-		namespace:  kube.options.Namespace,
-		name:       kube.options.DaemonSet,
-		annotation: annotation,
-		value:      kube.options.Node,
+		namespace: kube.options.Namespace,
+		name:      kube.options.DaemonSet,
+		options:   options,
+		node:      kube.options.Node,
+		pod:       kube.options.Pod,
 	}
 
 	if err := lock.connect(kube.config); err != nil {
@@ -57,3 +100,18 @@ func (kube *Kube) Lock(annotation string) (*Lock, error) {
 
 	return &lock, nil
 }
+
+func (kube *Kube) Lease(duration time.Duration) (*Lease, error) {
+	var lease = Lease{
+		namespace: kube.options.Namespace,
+		name:      kube.options.DaemonSet,
+		identity:  kube.options.Node,
+		duration:  duration,
+	}
+
+	if err := lease.connect(kube.config); err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
@@ -0,0 +1,48 @@
+package kube
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	fakeappsv1 "k8s.io/client-go/kubernetes/typed/apps/v1/fake"
+	coordinationv1beta1client "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	fakecoordinationv1beta1 "k8s.io/client-go/kubernetes/typed/coordination/v1beta1/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	fakecorev1 "k8s.io/client-go/kubernetes/typed/core/v1/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fake kube API client backed by an object tracker
+type testClient struct {
+	*k8stesting.Fake
+	tracker k8stesting.ObjectTracker
+}
+
+func makeTestClient(objects ...runtime.Object) testClient {
+	var client = testClient{
+		Fake:    &k8stesting.Fake{},
+		tracker: k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder()),
+	}
+
+	for _, obj := range objects {
+		if err := client.tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+
+	client.AddReactor("*", "*", k8stesting.ObjectReaction(client.tracker))
+
+	return client
+}
+
+func (client testClient) AppsV1() appsv1client.AppsV1Interface {
+	return &fakeappsv1.FakeAppsV1{Fake: client.Fake}
+}
+
+func (client testClient) CoreV1() corev1client.CoreV1Interface {
+	return &fakecorev1.FakeCoreV1{Fake: client.Fake}
+}
+
+func (client testClient) CoordinationV1beta1() coordinationv1beta1client.CoordinationV1beta1Interface {
+	return &fakecoordinationv1beta1.FakeCoordinationV1beta1{Fake: client.Fake}
+}
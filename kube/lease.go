@@ -0,0 +1,348 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1beta1client "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+const DefaultLeaseDuration = 15 * time.Minute
+
+// poll interval when waiting for the lease to be released or expire
+var leasePollInterval = 10 * time.Second
+
+// Lock using a coordination.k8s.io Lease, renewed while held
+//
+// Leases held by a deleted or NotReady node are taken over once expired.
+type Lease struct {
+	client     coordinationv1beta1client.CoordinationV1beta1Interface
+	nodeClient corev1client.CoreV1Interface
+	namespace  string
+	name       string
+	identity   string
+	duration   time.Duration
+
+	mutex sync.Mutex
+	stop  chan struct{}
+	lost  chan struct{}
+}
+
+func (lease *Lease) String() string {
+	return fmt.Sprintf("%v/leases/%v", lease.namespace, lease.name)
+}
+
+func (lease *Lease) connect(config *rest.Config) error {
+	if client, err := coordinationv1beta1client.NewForConfig(config); err != nil {
+		return err
+	} else {
+		lease.client = client
+	}
+
+	if client, err := corev1client.NewForConfig(config); err != nil {
+		return err
+	} else {
+		lease.nodeClient = client
+	}
+
+	return nil
+}
+
+func (lease *Lease) get() (*coordinationv1beta1.Lease, error) {
+	if obj, err := lease.client.Leases(lease.namespace).Get(lease.name, metav1.GetOptions{}); err != nil {
+		return nil, err // unmodified for IsNotFound
+	} else {
+		return obj, nil
+	}
+}
+
+func (lease *Lease) holder(obj *coordinationv1beta1.Lease) string {
+	if obj.Spec.HolderIdentity == nil {
+		return ""
+	} else {
+		return *obj.Spec.HolderIdentity
+	}
+}
+
+func (lease *Lease) expired(obj *coordinationv1beta1.Lease) bool {
+	var duration = lease.duration
+
+	if obj.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*obj.Spec.LeaseDurationSeconds) * time.Second
+	}
+
+	if obj.Spec.RenewTime == nil {
+		return true
+	} else {
+		return time.Now().After(obj.Spec.RenewTime.Add(duration))
+	}
+}
+
+// test lease holder
+func (lease *Lease) test(obj *coordinationv1beta1.Lease) (holder string, available bool, acquired bool, err error) {
+	if holder := lease.holder(obj); holder == "" {
+		log.Printf("kube/lease %v: test holder=%v: free", lease, holder)
+
+		return holder, true, false, nil
+
+	} else if holder == lease.identity {
+		log.Printf("kube/lease %v: test holder=%v: acquired", lease, holder)
+
+		return holder, true, true, nil
+
+	} else if !lease.expired(obj) {
+		log.Printf("kube/lease %v: test holder=%v: locked", lease, holder)
+
+		return holder, false, false, nil
+
+	} else if stale, reason, err := testStaleNode(lease.nodeClient, holder, 0); err != nil {
+		return holder, false, false, err
+
+	} else if stale {
+		log.Printf("kube/lease %v: test holder=%v: expired (%v)", lease, holder, reason)
+
+		return holder, true, false, nil
+
+	} else {
+		log.Printf("kube/lease %v: test holder=%v: expired, but node is ready", lease, holder)
+
+		return holder, false, false, nil
+	}
+}
+
+func (lease *Lease) set(obj *coordinationv1beta1.Lease) {
+	var now = metav1.NewMicroTime(time.Now())
+	var durationSeconds = int32(lease.duration.Seconds())
+	var identity = lease.identity
+
+	if lease.holder(obj) != identity {
+		var transitions int32
+
+		if obj.Spec.LeaseTransitions != nil {
+			transitions = *obj.Spec.LeaseTransitions + 1
+		}
+
+		obj.Spec.AcquireTime = &now
+		obj.Spec.LeaseTransitions = &transitions
+	}
+
+	obj.Spec.HolderIdentity = &identity
+	obj.Spec.LeaseDurationSeconds = &durationSeconds
+	obj.Spec.RenewTime = &now
+}
+
+func (lease *Lease) clear(obj *coordinationv1beta1.Lease) {
+	obj.Spec.HolderIdentity = nil
+	obj.Spec.AcquireTime = nil
+	obj.Spec.RenewTime = nil
+}
+
+func (lease *Lease) create() error {
+	var obj = coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: lease.namespace,
+			Name:      lease.name,
+		},
+	}
+
+	lease.set(&obj)
+
+	log.Printf("kube/lease %v: create holder=%v", lease, lease.identity)
+
+	if _, err := lease.client.Leases(lease.namespace).Create(&obj); err != nil {
+		return err // unmodified for IsAlreadyExists
+	}
+
+	return nil
+}
+
+func (lease *Lease) update(obj *coordinationv1beta1.Lease) error {
+	if _, err := lease.client.Leases(lease.namespace).Update(obj); err != nil {
+		return err // unmodified for IsConflict
+	}
+
+	return nil
+}
+
+// attempt to acquire the lease once
+func (lease *Lease) tryAcquire() (bool, error) {
+	obj, err := lease.get()
+	if err != nil && errors.IsNotFound(err) {
+		if err := lease.create(); err != nil && errors.IsAlreadyExists(err) {
+			log.Printf("kube/lease %v: create conflict: %v", lease, err)
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("Create: %v", err)
+		} else {
+			return true, nil
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("Get: %v", err)
+	}
+
+	if _, available, _, err := lease.test(obj); err != nil {
+		return false, err
+	} else if !available {
+		return false, nil
+	}
+
+	lease.set(obj)
+
+	if err := lease.update(obj); err != nil && errors.IsConflict(err) {
+		log.Printf("kube/lease %v: update conflict: %v", lease, err)
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Update: %v", err)
+	}
+
+	log.Printf("kube/lease %v: acquired holder=%v", lease, lease.identity)
+
+	return true, nil
+}
+
+// renew lease until stopped, or lost, closing the lost channel
+func (lease *Lease) renew(stop chan struct{}, lost chan struct{}) {
+	var interval = lease.duration / 3
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		obj, err := lease.get()
+		if err != nil {
+			log.Printf("kube/lease %v: renew failed: Get: %v", lease, err)
+			continue
+		} else if holder := lease.holder(obj); holder != lease.identity {
+			log.Printf("kube/lease %v: renew failed: lost lease to holder=%v", lease, holder)
+			close(lost)
+			return
+		}
+
+		lease.set(obj)
+
+		if err := lease.update(obj); err != nil {
+			log.Printf("kube/lease %v: renew failed: Update: %v", lease, err)
+		} else {
+			log.Printf("kube/lease %v: renewed", lease)
+		}
+	}
+}
+
+func (lease *Lease) startRenew() {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	if lease.stop == nil {
+		lease.stop = make(chan struct{})
+		lease.lost = make(chan struct{})
+
+		go lease.renew(lease.stop, lease.lost)
+	}
+}
+
+func (lease *Lease) stopRenew() {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	if lease.stop != nil {
+		close(lease.stop)
+
+		lease.stop = nil
+		lease.lost = nil
+	}
+}
+
+// Test lease holder
+func (lease *Lease) Test() (string, bool, error) {
+	if obj, err := lease.get(); err != nil && errors.IsNotFound(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("Get: %v", err)
+	} else {
+		return lease.holder(obj), lease.holder(obj) == lease.identity, nil
+	}
+}
+
+// Get lease holder, if any
+func (lease *Lease) Holders() ([]string, error) {
+	if holder, _, err := lease.Test(); err != nil {
+		return nil, err
+	} else if holder == "" {
+		return nil, nil
+	} else {
+		return []string{holder}, nil
+	}
+}
+
+// wait for lease to be free or expire and acquire it, renewing it until released
+func (lease *Lease) Acquire(ctx context.Context) error {
+	for {
+		if acquired, err := lease.tryAcquire(); err != nil {
+			return err
+		} else if acquired {
+			lease.startRenew()
+
+			return nil
+		}
+
+		log.Printf("kube/lease %v: wait", lease)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+// closed if the lease is lost to another holder while renewing
+func (lease *Lease) Lost() <-chan struct{} {
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	return lease.lost
+}
+
+// the lease holder identity does not record any phase
+func (lease *Lease) SetPhase(phase LockPhase) error {
+	log.Printf("kube/lease %v: phase=%v", lease, phase)
+
+	return nil
+}
+
+// release lease, failing if not held
+func (lease *Lease) Release() error {
+	lease.stopRenew()
+
+	for {
+		obj, err := lease.get()
+		if err != nil {
+			return fmt.Errorf("Get: %v", err)
+		} else if holder := lease.holder(obj); holder != lease.identity {
+			return fmt.Errorf("Broken lease: holder=%v, expected %v", holder, lease.identity)
+		}
+
+		lease.clear(obj)
+
+		if err := lease.update(obj); err != nil && errors.IsConflict(err) {
+			log.Printf("kube/lease %v: retry release conflict: %v", lease, err)
+		} else if err != nil {
+			return fmt.Errorf("Update: %v", err)
+		} else {
+			log.Printf("kube/lease %v: released", lease)
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func init() {
+	leasePollInterval = 10 * time.Millisecond
+}
+
+func makeTestLease(identity string, objects ...runtime.Object) (*Lease, testClient) {
+	var client = makeTestClient(objects...)
+	var lease = Lease{
+		client:     client.CoordinationV1beta1(),
+		nodeClient: client.CoreV1(),
+		namespace:  "kube-system",
+		name:       "host-upgrades",
+		identity:   identity,
+		duration:   DefaultLeaseDuration,
+	}
+
+	return &lease, client
+}
+
+func makeTestLeaseObject(holder string, renewTime time.Time) *coordinationv1beta1.Lease {
+	var durationSeconds = int32(60)
+	var microTime = metav1.NewMicroTime(renewTime)
+
+	return &coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      "host-upgrades",
+		},
+		Spec: coordinationv1beta1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &durationSeconds,
+			AcquireTime:          &microTime,
+			RenewTime:            &microTime,
+		},
+	}
+}
+
+func makeTestNodeObject(name string, ready corev1.ConditionStatus) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: ready},
+			},
+		},
+	}
+}
+
+func getTestLeaseHolder(t *testing.T, lease *Lease) string {
+	obj, err := lease.client.Leases(lease.namespace).Get(lease.name, metav1.GetOptions{})
+
+	if assert.NoError(t, err) && obj.Spec.HolderIdentity != nil {
+		return *obj.Spec.HolderIdentity
+	} else {
+		return ""
+	}
+}
+
+func TestLeaseAcquireRelease(t *testing.T) {
+	lease, _ := makeTestLease("test")
+
+	value, acquired, err := lease.Test()
+	assert.NoError(t, err, "Test")
+	assert.False(t, acquired, "Test acquired")
+	assert.Equal(t, "", value)
+
+	assert.NoError(t, lease.Acquire(context.Background()), "Acquire")
+	assert.Equal(t, "test", getTestLeaseHolder(t, lease))
+
+	value, acquired, err = lease.Test()
+	assert.NoError(t, err, "Test")
+	assert.True(t, acquired, "Test acquired")
+	assert.Equal(t, "test", value)
+
+	holders, err := lease.Holders()
+	assert.NoError(t, err, "Holders")
+	assert.Equal(t, []string{"test"}, holders)
+
+	assert.NoError(t, lease.Release(), "Release")
+	assert.Equal(t, "", getTestLeaseHolder(t, lease))
+
+	holders, err = lease.Holders()
+	assert.NoError(t, err, "Holders")
+	assert.Empty(t, holders)
+
+	assert.Error(t, lease.Release(), "Release when not held")
+}
+
+func TestLeaseAcquireLocked(t *testing.T) {
+	lease, _ := makeTestLease("test",
+		makeTestLeaseObject("other", time.Now()),
+		makeTestNodeObject("other", corev1.ConditionFalse),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.EqualError(t, lease.Acquire(ctx), "context deadline exceeded")
+	assert.Equal(t, "other", getTestLeaseHolder(t, lease))
+}
+
+func TestLeaseAcquireExpiredReady(t *testing.T) {
+	lease, _ := makeTestLease("test",
+		makeTestLeaseObject("other", time.Now().Add(-1*time.Hour)),
+		makeTestNodeObject("other", corev1.ConditionTrue),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.EqualError(t, lease.Acquire(ctx), "context deadline exceeded")
+	assert.Equal(t, "other", getTestLeaseHolder(t, lease))
+}
+
+func TestLeaseAcquireExpiredNotReady(t *testing.T) {
+	lease, _ := makeTestLease("test",
+		makeTestLeaseObject("other", time.Now().Add(-1*time.Hour)),
+		makeTestNodeObject("other", corev1.ConditionFalse),
+	)
+
+	assert.NoError(t, lease.Acquire(context.Background()), "Acquire")
+	assert.Equal(t, "test", getTestLeaseHolder(t, lease))
+
+	lease.stopRenew()
+}
+
+func TestLeaseAcquireExpiredDeleted(t *testing.T) {
+	lease, _ := makeTestLease("test",
+		makeTestLeaseObject("other", time.Now().Add(-1*time.Hour)),
+	)
+
+	assert.NoError(t, lease.Acquire(context.Background()), "Acquire")
+	assert.Equal(t, "test", getTestLeaseHolder(t, lease))
+
+	lease.stopRenew()
+}
+
+func TestLeaseLost(t *testing.T) {
+	lease, _ := makeTestLease("test")
+	lease.duration = 30 * time.Millisecond
+
+	assert.Nil(t, lease.Lost(), "Lost before Acquire")
+	assert.NoError(t, lease.Acquire(context.Background()), "Acquire")
+
+	var lost = lease.Lost()
+
+	select {
+	case <-lost:
+		t.Fatalf("Lost before takeover")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	obj, err := lease.get()
+	if assert.NoError(t, err) {
+		var other = "other"
+
+		obj.Spec.HolderIdentity = &other
+
+		assert.NoError(t, lease.update(obj))
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(1 * time.Second):
+		t.Errorf("Not lost after takeover")
+	}
+
+	assert.EqualError(t, lease.Release(), "Broken lease: holder=other, expected test")
+	assert.Nil(t, lease.Lost(), "Lost after Release")
+}
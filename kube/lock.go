@@ -4,26 +4,69 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	watchtools "k8s.io/client-go/tools/watch"
 )
 
+type LockOptions struct {
+	Annotation string
+
+	// annotation for the last issued fencing token, kept once the lock annotation is removed
+	TokenAnnotation string
+
+	// default maximum number of concurrent lock holders, as an absolute number or percentage of the DaemonSet pods
+	MaxConcurrent intstr.IntOrString
+
+	// DaemonSet annotation to override the MaxConcurrent value
+	MaxConcurrentAnnotation string
+
+	// node label used to allow at most one lock holder per topology domain, empty to disable
+	TopologyKey string
+
+	// agent version, recorded in the lock holder
+	Version string
+
+	// take over the lock from holders whose node is deleted, or NotReady for longer than this, zero to disable
+	StaleTimeout time.Duration
+}
+
+// interval for re-checking lock holders for staleness while waiting
+var lockStaleInterval = 1 * time.Minute
+
+// Lock using an annotation on the DaemonSet, with a set of up to MaxConcurrent holders
 type Lock struct {
 	client     appsv1client.AppsV1Interface
+	coreClient corev1client.CoreV1Interface // nodes, events
 	namespace  string
 	name       string
-	annotation string
-	value      string
+	options    LockOptions
+	node       string
+	pod        string
+
+	// topology domain of this node, read from the TopologyKey node label when acquiring
+	domain string
+}
+
+// stale lock holder removed when acquiring the lock
+type lockTakeover struct {
+	Holder lockHolder
+	Reason string
 }
 
 func (lock *Lock) String() string {
@@ -37,57 +80,238 @@ func (lock *Lock) connect(config *rest.Config) error {
 		lock.client = client
 	}
 
+	if client, err := corev1client.NewForConfig(config); err != nil {
+		return err
+	} else {
+		lock.coreClient = client
+	}
+
 	return nil
 }
 
+// maximum number of lock holders
+func (lock *Lock) limit(object runtime.Object) int {
+	ds, ok := object.(*appsv1.DaemonSet)
+	if !ok {
+		panic(fmt.Errorf("Invalid object: %T", object))
+	}
+
+	var maxConcurrent = lock.options.MaxConcurrent
+	var total = int(ds.Status.DesiredNumberScheduled)
+
+	if value := ds.Annotations[lock.options.MaxConcurrentAnnotation]; lock.options.MaxConcurrentAnnotation != "" && value != "" {
+		maxConcurrent = intstr.Parse(value)
+	}
+
+	if limit, err := intstr.GetValueFromIntOrPercent(&maxConcurrent, total, false); err != nil {
+		log.Printf("kube/lock %v: invalid max-concurrent=%v, using 1: %v", lock, maxConcurrent.String(), err)
+
+		return 1
+	} else if limit < 1 {
+		return 1
+	} else {
+		return limit
+	}
+}
+
+func (lock *Lock) holder() lockHolder {
+	var holder = lockHolder{
+		Node:       lock.node,
+		Pod:        lock.pod,
+		AcquiredAt: time.Now().UTC(),
+		Phase:      LockPhaseUpgrading,
+		Version:    lock.options.Version,
+	}
+
+	if lock.options.TopologyKey != "" {
+		holder.Domain = lock.domain
+	}
+
+	return holder
+}
+
+// other lock holder within the same topology domain, if using a TopologyKey
+func (lock *Lock) domainHolder(lockValue lockValue) (lockHolder, bool) {
+	if lock.options.TopologyKey == "" {
+		return lockHolder{}, false
+	} else {
+		return lockValue.domainHolder(lock.domain)
+	}
+}
+
+// read the topology domain of this node, unlabeled nodes share the same empty domain
+func (lock *Lock) getDomain() (string, error) {
+	if lock.options.TopologyKey == "" {
+		return "", nil
+	}
+
+	node, err := lock.coreClient.Nodes().Get(lock.node, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("Get node %v: %v", lock.node, err)
+	}
+
+	if value, exists := node.Labels[lock.options.TopologyKey]; !exists {
+		log.Printf("kube/lock %v: node %v is missing the topology label %v", lock, lock.node, lock.options.TopologyKey)
+
+		return "", nil
+	} else {
+		log.Printf("kube/lock %v: node %v topology %v=%v", lock, lock.node, lock.options.TopologyKey, value)
+
+		return value, nil
+	}
+}
+
 // test for lock annotation
 func (lock *Lock) test(object runtime.Object) (value string, available bool, acquired bool) {
+	var limit = lock.limit(object)
+
 	if accessor, err := meta.Accessor(object); err != nil {
 		panic(err)
-	} else if value := accessor.GetAnnotations()[lock.annotation]; value == "" {
-		log.Printf("kube/lock %v: test %v=%v: free", lock, lock.annotation, value)
+	} else if lockValue, err := parseLockValue(accessor.GetAnnotations()[lock.options.Annotation]); err != nil {
+		log.Printf("kube/lock %v: test %v: %v", lock, lock.options.Annotation, err)
 
-		return value, true, false
+		return accessor.GetAnnotations()[lock.options.Annotation], false, false
 
-	} else if value == lock.value {
-		log.Printf("kube/lock %v: test %v=%v: acquired", lock, lock.annotation, value)
+	} else if value := strings.Join(lockValue.Nodes(), ","); lockValue.hasHolder(lock.node) {
+		log.Printf("kube/lock %v: test %v=%v: acquired (%d/%d holders)", lock, lock.options.Annotation, lockValue.Describe(), len(lockValue.Holders), limit)
 
 		return value, true, true
 
+	} else if holder, exists := lock.domainHolder(lockValue); exists {
+		log.Printf("kube/lock %v: test %v=%v: locked by %v in %v=%v", lock, lock.options.Annotation, lockValue.Describe(), holder, lock.options.TopologyKey, holder.Domain)
+
+		return value, false, false
+
+	} else if len(lockValue.Holders) < limit {
+		log.Printf("kube/lock %v: test %v=%v: free (%d/%d holders)", lock, lock.options.Annotation, lockValue.Describe(), len(lockValue.Holders), limit)
+
+		return value, true, false
+
 	} else {
-		log.Printf("kube/lock %v: test %v=%v: locked", lock, lock.annotation, value)
+		log.Printf("kube/lock %v: test %v=%v: locked (%d/%d holders)", lock, lock.options.Annotation, lockValue.Describe(), len(lockValue.Holders), limit)
 
 		return value, false, false
 	}
 }
 
-// set lock annotation
-// fails if not clear or acquired
+// parse the lock annotation, with the last issued fencing token from the token annotation, or a legacy lock annotation
+func (lock *Lock) getValue(annotations map[string]string) (lockValue, error) {
+	lockValue, err := parseLockValue(annotations[lock.options.Annotation])
+	if err != nil {
+		return lockValue, err
+	}
+
+	if value := annotations[lock.options.TokenAnnotation]; value != "" {
+		token, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return lockValue, fmt.Errorf("Invalid lock token %v=%v: %v", lock.options.TokenAnnotation, value, err)
+		}
+
+		if token > lockValue.Token {
+			lockValue.Token = token
+		}
+	}
+
+	return lockValue, nil
+}
+
+// store the lock holders and fencing token, removing the lock annotation once there are no holders
+func (lock *Lock) setValue(annotations map[string]string, lockValue lockValue) {
+	if value := lockValue.String(); value == "" {
+		delete(annotations, lock.options.Annotation)
+	} else {
+		annotations[lock.options.Annotation] = value
+	}
+
+	if lockValue.Token != 0 {
+		annotations[lock.options.TokenAnnotation] = strconv.FormatUint(lockValue.Token, 10)
+	}
+}
+
+// add lock holder to annotation
+// fails if not available or acquired
 func (lock *Lock) set(object *runtime.Object) error {
-	if accessor, err := meta.Accessor(*object); err != nil {
+	var limit = lock.limit(*object)
+
+	accessor, err := meta.Accessor(*object)
+	if err != nil {
 		panic(err)
-	} else if value := accessor.GetAnnotations()[lock.annotation]; value != "" && value != lock.value {
-		return fmt.Errorf("Busy lock: %v=%v", lock.annotation, value)
+	}
+
+	var annotations = accessor.GetAnnotations()
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	if lockValue, err := lock.getValue(annotations); err != nil {
+		return err
+	} else if lockValue.hasHolder(lock.node) {
+		log.Printf("kube/lock %v: set %v: already acquired", lock, lock.options.Annotation)
+	} else if holder, exists := lock.domainHolder(lockValue); exists {
+		return fmt.Errorf("Busy lock: %v=%v in %v=%v", lock.options.Annotation, holder.Node, lock.options.TopologyKey, holder.Domain)
+	} else if len(lockValue.Holders) >= limit {
+		return fmt.Errorf("Busy lock: %v=%v", lock.options.Annotation, strings.Join(lockValue.Nodes(), ","))
 	} else {
-		log.Printf("kube/lock %v: set %v=%v", lock, lock.annotation, lock.value)
+		var holder = lockValue.addHolder(lock.holder())
+
+		log.Printf("kube/lock %v: set %v=%v (token %d)", lock, lock.options.Annotation, lockValue.Describe(), holder.Token)
 
-		accessor.GetAnnotations()[lock.annotation] = lock.value
+		lock.setValue(annotations, lockValue)
 	}
 
+	accessor.SetAnnotations(annotations)
+
 	return nil
 }
 
-// clear lock annotation
+// remove lock holder from annotation
 // fails if not set
 func (lock *Lock) clear(object *runtime.Object) error {
-	if accessor, err := meta.Accessor(*object); err != nil {
+	accessor, err := meta.Accessor(*object)
+	if err != nil {
 		panic(err)
-	} else if value := accessor.GetAnnotations()[lock.annotation]; value != lock.value {
-		return fmt.Errorf("Broken lock: %v=%v, expected %v", lock.annotation, value, lock.value)
+	}
+
+	var annotations = accessor.GetAnnotations()
+
+	if lockValue, err := lock.getValue(annotations); err != nil {
+		return err
+	} else if !lockValue.removeHolder(lock.node) {
+		return fmt.Errorf("Broken lock: %v=%v, expected %v", lock.options.Annotation, annotations[lock.options.Annotation], lock.node)
+	} else if len(lockValue.Holders) == 0 {
+		log.Printf("kube/lock %v: clear %v", lock, lock.options.Annotation)
+
+		lock.setValue(annotations, lockValue)
 	} else {
-		log.Printf("kube/lock %v: clear %v=%v", lock, lock.annotation, value)
+		log.Printf("kube/lock %v: clear %v=%v", lock, lock.options.Annotation, lockValue.Describe())
 
-		delete(accessor.GetAnnotations(), lock.annotation)
+		lock.setValue(annotations, lockValue)
+	}
+
+	return nil
+}
+
+// update lock holder phase in annotation
+// fails if not set
+func (lock *Lock) setPhase(object *runtime.Object, phase LockPhase) error {
+	accessor, err := meta.Accessor(*object)
+	if err != nil {
+		panic(err)
+	}
+
+	var annotations = accessor.GetAnnotations()
+
+	if lockValue, err := lock.getValue(annotations); err != nil {
+		return err
+	} else if holder := lockValue.getHolder(lock.node); holder == nil {
+		return fmt.Errorf("Broken lock: %v=%v, expected %v", lock.options.Annotation, annotations[lock.options.Annotation], lock.node)
+	} else {
+		holder.Phase = phase
+
+		log.Printf("kube/lock %v: set %v phase=%v", lock, lock.options.Annotation, phase)
+
+		lock.setValue(annotations, lockValue)
 	}
 
 	return nil
@@ -115,6 +339,17 @@ func (lock *Lock) Test() (value string, acquired bool, err error) {
 	}
 }
 
+// Get lock holder nodes, quietly for polling
+func (lock *Lock) Holders() ([]string, error) {
+	if object, err := lock.client.DaemonSets(lock.namespace).Get(lock.name, metav1.GetOptions{}); err != nil {
+		return nil, fmt.Errorf("Get: %v", err)
+	} else if lockValue, err := parseLockValue(object.Annotations[lock.options.Annotation]); err != nil {
+		return nil, err
+	} else {
+		return lockValue.Nodes(), nil
+	}
+}
+
 // watch lock object
 func (lock *Lock) watch(object runtime.Object) (watch.Interface, error) {
 	var listOptions metav1.ListOptions
@@ -189,32 +424,135 @@ func (lock *Lock) testEvent(event watch.Event) (bool, error) {
 	return false, nil
 }
 
-func contextTimeout(ctx context.Context) time.Duration {
-	if deadline, ok := ctx.Deadline(); !ok {
-		return time.Duration(0)
-	} else {
-		return deadline.Sub(time.Now())
+// watch until the condition is met, failing with wait.ErrWaitTimeout once the context is done, or after the optional timeout
+func watchUntil(ctx context.Context, timeout time.Duration, watcher watch.Interface, condition watchtools.ConditionFunc) (*watch.Event, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return watchtools.UntilWithoutRetry(ctx, watcher, condition)
+}
+
+// remove any stale holders from a copy of the lock object
+// returns nil if there are no stale holders
+func (lock *Lock) breakStale(object runtime.Object) (runtime.Object, []lockTakeover, error) {
+	if lock.options.StaleTimeout == 0 {
+		return nil, nil, nil
 	}
+
+	var broken = object.DeepCopyObject()
+	var takeovers []lockTakeover
+
+	accessor, err := meta.Accessor(broken)
+	if err != nil {
+		panic(err)
+	}
+
+	var annotations = accessor.GetAnnotations()
+
+	lockValue, err := lock.getValue(annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, holder := range append([]lockHolder(nil), lockValue.Holders...) {
+		if holder.Node == lock.node {
+			continue
+		} else if stale, reason, err := testStaleNode(lock.coreClient, holder.Node, lock.options.StaleTimeout); err != nil {
+			return nil, nil, err
+		} else if stale {
+			log.Printf("kube/lock %v: break stale holder %v: %v", lock, holder, reason)
+
+			lockValue.removeHolder(holder.Node)
+
+			takeovers = append(takeovers, lockTakeover{Holder: holder, Reason: reason})
+		}
+	}
+
+	if len(takeovers) == 0 {
+		return nil, nil, nil
+	}
+
+	lock.setValue(annotations, lockValue)
+
+	accessor.SetAnnotations(annotations)
+
+	return broken, takeovers, nil
 }
 
-// wait for lock to be free
-func (lock *Lock) wait(ctx context.Context, object *runtime.Object) error {
+// wait for lock to be free, or for any stale holders to be broken
+//
+// The broken holders are only removed by the conditional update when acquiring the lock,
+// failing with a conflict if the lock was concurrently modified by any other waiter.
+func (lock *Lock) wait(ctx context.Context, object *runtime.Object) ([]lockTakeover, error) {
 	log.Printf("kube/lock %v: wait", lock)
 
-	if _, available, _ := lock.test(*object); available {
-		// fastpath
-		return nil
-	} else if watcher, err := lock.watch(*object); err != nil {
-		return err
-	} else if ev, err := watch.Until(contextTimeout(ctx), watcher, lock.testEvent); err != nil {
-		log.Printf("kube/lock %v: wait err: %v", lock, err)
-		return err
-	} else {
-		log.Printf("kube/lock %v: wait ok", lock)
+	for {
+		var timeout time.Duration
+
+		if _, available, _ := lock.test(*object); available {
+			// fastpath
+			return nil, nil
+		} else if broken, takeovers, err := lock.breakStale(*object); err != nil {
+			return nil, err
+		} else if broken != nil {
+			if _, available, _ := lock.test(broken); available {
+				*object = broken
+
+				return takeovers, nil
+			}
+		}
+
+		// re-check stale holders periodically
+		if lock.options.StaleTimeout != 0 {
+			timeout = lockStaleInterval
+		}
+
+		if watcher, err := lock.watch(*object); err != nil {
+			return nil, err
+		} else if ev, err := watchUntil(ctx, timeout, watcher, lock.testEvent); err == wait.ErrWaitTimeout && lock.options.StaleTimeout != 0 && ctx.Err() == nil {
+			log.Printf("kube/lock %v: wait timeout, re-checking for stale holders", lock)
+
+			if obj, err := lock.get(); err != nil {
+				return nil, err
+			} else {
+				*object = obj
+			}
+		} else if err != nil {
+			log.Printf("kube/lock %v: wait err: %v", lock, err)
+			return nil, err
+		} else {
+			log.Printf("kube/lock %v: wait ok", lock)
+
+			*object = ev.Object
 
-		*object = ev.Object
+			return nil, nil
+		}
+	}
+}
+
+// record a kube Event for the lock takeover, failures are only logged
+func (lock *Lock) recordTakeover(object runtime.Object, takeover lockTakeover) {
+	var ref = corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "DaemonSet",
+		Namespace:  lock.namespace,
+		Name:       lock.name,
+	}
+	var message = fmt.Sprintf("Node %v took over lock %v from stale holder %v: %v", lock.node, lock.options.Annotation, takeover.Holder.Node, takeover.Reason)
+
+	if accessor, err := meta.Accessor(object); err != nil {
+		panic(err)
+	} else {
+		ref.UID = accessor.GetUID()
+		ref.ResourceVersion = accessor.GetResourceVersion()
+	}
 
-		return nil
+	if err := createEvent(lock.coreClient, lock.namespace, ref, makeEventSource(lock.node), corev1.EventTypeWarning, "LockTakeover", message); err != nil {
+		log.Printf("kube/lock %v: failed to record takeover event: %v", lock, err)
 	}
 }
 
@@ -225,17 +563,40 @@ func (lock *Lock) acquire(object *runtime.Object) error {
 	return lock.set(object)
 }
 
-// wait for lock to free and acquire it
+// wait for lock to free and acquire it, taking over from any stale holders
 func (lock *Lock) Acquire(ctx context.Context) error {
-	return lock.modify(ctx, func(object *runtime.Object) error {
-		if err := lock.wait(ctx, object); err != nil {
+	var lockObject *runtime.Object
+	var lockTakeovers []lockTakeover
+
+	// the node may have been relabeled since the lock was last acquired
+	if domain, err := lock.getDomain(); err != nil {
+		return fmt.Errorf("Failed to get node topology: %v", err)
+	} else {
+		lock.domain = domain
+	}
+
+	if err := lock.modify(ctx, func(object *runtime.Object) error {
+		if takeovers, err := lock.wait(ctx, object); err != nil {
 			return err
 		} else if err := lock.acquire(object); err != nil {
 			return err
 		} else {
+			lockObject = object // updated in place
+			lockTakeovers = takeovers
+
 			return nil
 		}
-	})
+	}); err != nil {
+		return err
+	}
+
+	for _, takeover := range lockTakeovers {
+		log.Printf("kube/lock %v: took over lock from stale holder %v: %v", lock, takeover.Holder, takeover.Reason)
+
+		lock.recordTakeover(*lockObject, takeover)
+	}
+
+	return nil
 }
 
 // attempt to clear lock, assuming it is locked
@@ -245,6 +606,11 @@ func (lock *Lock) release(object *runtime.Object) error {
 	return lock.clear(object)
 }
 
+// the lock annotation is held until released, and is never lost
+func (lock *Lock) Lost() <-chan struct{} {
+	return nil
+}
+
 // attempt to release lock, assuming it is set
 func (lock *Lock) Release() error {
 	return lock.modify(context.Background(), func(object *runtime.Object) error {
@@ -252,6 +618,13 @@ func (lock *Lock) Release() error {
 	})
 }
 
+// update the lock holder phase, failing if not held
+func (lock *Lock) SetPhase(phase LockPhase) error {
+	return lock.modify(context.Background(), func(object *runtime.Object) error {
+		return lock.setPhase(object, phase)
+	})
+}
+
 func (lock *Lock) cleanup() {
 	if err := lock.Release(); err != nil {
 		log.Printf("Failed to release lock %v: %v", lock, err)
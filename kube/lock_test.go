@@ -0,0 +1,366 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func init() {
+	lockStaleInterval = 10 * time.Millisecond
+}
+
+const testLockAnnotation = "test/lock"
+const testLockTokenAnnotation = "test/lock-token"
+const testMaxConcurrentAnnotation = "test/max-concurrent"
+
+func makeTestLock(node string, maxConcurrent int, ds *appsv1.DaemonSet) (*Lock, testClient) {
+	var client = makeTestClient(ds)
+	var lock = Lock{
+		client:     client.AppsV1(),
+		coreClient: client.CoreV1(),
+		namespace:  "kube-system",
+		name:       "host-upgrades",
+		options: LockOptions{
+			Annotation:              testLockAnnotation,
+			TokenAnnotation:         testLockTokenAnnotation,
+			MaxConcurrent:           intstr.FromInt(maxConcurrent),
+			MaxConcurrentAnnotation: testMaxConcurrentAnnotation,
+		},
+		node: node,
+	}
+
+	return &lock, client
+}
+
+func makeTestDaemonSet(pods int32, annotations map[string]string) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "kube-system",
+			Name:        "host-upgrades",
+			Annotations: annotations,
+		},
+		Status: appsv1.DaemonSetStatus{
+			DesiredNumberScheduled: pods,
+		},
+	}
+}
+
+func getTestLockAnnotation(t *testing.T, lock *Lock) string {
+	obj, err := lock.client.DaemonSets(lock.namespace).Get(lock.name, metav1.GetOptions{})
+
+	assert.NoError(t, err)
+
+	return obj.Annotations[testLockAnnotation]
+}
+
+func getTestLockToken(t *testing.T, lock *Lock) string {
+	obj, err := lock.client.DaemonSets(lock.namespace).Get(lock.name, metav1.GetOptions{})
+
+	assert.NoError(t, err)
+
+	return obj.Annotations[testLockTokenAnnotation]
+}
+
+func getTestLockValue(t *testing.T, lock *Lock) lockValue {
+	lockValue, err := parseLockValue(getTestLockAnnotation(t, lock))
+
+	assert.NoError(t, err)
+
+	return lockValue
+}
+
+func TestLockValue(t *testing.T) {
+	for value, nodes := range map[string][]string{
+		"":     []string{},
+		"test": []string{"test"},
+		`{"holders":[{"node":"test1"},{"node":"test2"}]}`: []string{"test1", "test2"},
+	} {
+		lockValue, err := parseLockValue(value)
+
+		if assert.NoErrorf(t, err, "parseLockValue %#v", value) {
+			assert.Equal(t, nodes, lockValue.Nodes())
+		}
+	}
+
+	_, err := parseLockValue(`{"holders"`)
+	assert.Error(t, err, "parseLockValue invalid")
+
+	lockValue, err := parseLockValue(`{"holders":[{"node":"test","pod":"test-pod","acquiredAt":"2018-10-01T03:00:00Z","phase":"draining","version":"0.3.1","token":3}],"token":3}`)
+	if assert.NoError(t, err, "parseLockValue record") {
+		assert.Equal(t, lockHolder{
+			Node:       "test",
+			Pod:        "test-pod",
+			AcquiredAt: time.Date(2018, 10, 1, 3, 0, 0, 0, time.UTC),
+			Phase:      LockPhaseDraining,
+			Version:    "0.3.1",
+			Token:      3,
+		}, lockValue.Holders[0])
+		assert.Equal(t, uint64(3), lockValue.Token)
+	}
+}
+
+func TestLockAcquireRelease(t *testing.T) {
+	lock, _ := makeTestLock("test", 1, makeTestDaemonSet(3, map[string]string{}))
+	lock.pod = "test-pod"
+	lock.options.Version = "0.3.1"
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire")
+
+	if lockValue := getTestLockValue(t, lock); assert.Len(t, lockValue.Holders, 1) {
+		var holder = lockValue.Holders[0]
+
+		assert.Equal(t, "test", holder.Node)
+		assert.Equal(t, "test-pod", holder.Pod)
+		assert.Equal(t, LockPhaseUpgrading, holder.Phase)
+		assert.Equal(t, "0.3.1", holder.Version)
+		assert.Equal(t, uint64(1), holder.Token)
+		assert.WithinDuration(t, time.Now(), holder.AcquiredAt, time.Minute)
+	}
+
+	value, acquired, err := lock.Test()
+	assert.NoError(t, err, "Test")
+	assert.True(t, acquired, "Test acquired")
+	assert.Equal(t, "test", value)
+
+	assert.NoError(t, lock.SetPhase(LockPhaseRebooting), "SetPhase")
+
+	if lockValue := getTestLockValue(t, lock); assert.Len(t, lockValue.Holders, 1) {
+		assert.Equal(t, LockPhaseRebooting, lockValue.Holders[0].Phase)
+	}
+
+	assert.NoError(t, lock.Release(), "Release")
+	assert.Equal(t, "", getTestLockAnnotation(t, lock), "annotation is removed")
+	assert.Equal(t, "1", getTestLockToken(t, lock), "token is preserved")
+
+	assert.Error(t, lock.Release(), "Release when not held")
+	assert.Error(t, lock.SetPhase(LockPhaseDraining), "SetPhase when not held")
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire again")
+
+	if lockValue := getTestLockValue(t, lock); assert.Len(t, lockValue.Holders, 1) {
+		assert.Equal(t, uint64(2), lockValue.Holders[0].Token)
+	}
+}
+
+func TestLockAcquireLegacyToken(t *testing.T) {
+	lock, _ := makeTestLock("test", 1, makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: `{"holders":[],"token":3}`,
+	}))
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire")
+
+	if lockValue := getTestLockValue(t, lock); assert.Len(t, lockValue.Holders, 1) {
+		assert.Equal(t, uint64(4), lockValue.Holders[0].Token)
+	}
+
+	assert.Equal(t, "4", getTestLockToken(t, lock), "token is migrated")
+
+	assert.NoError(t, lock.Release(), "Release")
+	assert.Equal(t, "", getTestLockAnnotation(t, lock), "annotation is removed")
+	assert.Equal(t, "4", getTestLockToken(t, lock), "token is preserved")
+}
+
+func TestLockTestLegacy(t *testing.T) {
+	lock, _ := makeTestLock("test", 1, makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: "test",
+	}))
+
+	value, acquired, err := lock.Test()
+	assert.NoError(t, err, "Test")
+	assert.True(t, acquired, "Test acquired")
+	assert.Equal(t, "test", value)
+
+	assert.NoError(t, lock.Release(), "Release")
+	assert.Equal(t, "", getTestLockAnnotation(t, lock))
+}
+
+func TestLockConcurrent(t *testing.T) {
+	lock, _ := makeTestLock("test", 2, makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: "other",
+	}))
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire")
+	assert.Equal(t, []string{"other", "test"}, getTestLockValue(t, lock).Nodes())
+
+	holders, err := lock.Holders()
+	assert.NoError(t, err, "Holders")
+	assert.Equal(t, []string{"other", "test"}, holders)
+
+	assert.NoError(t, lock.Release(), "Release")
+	assert.Equal(t, []string{"other"}, getTestLockValue(t, lock).Nodes())
+
+	holders, err = lock.Holders()
+	assert.NoError(t, err, "Holders")
+	assert.Equal(t, []string{"other"}, holders)
+}
+
+func TestLockLimit(t *testing.T) {
+	for _, test := range []struct {
+		maxConcurrent int
+		pods          int32
+		annotation    string
+		limit         int
+	}{
+		{1, 3, "", 1},
+		{2, 3, "", 2},
+		{1, 10, "3", 3},
+		{1, 10, "25%", 2},
+		{1, 1, "25%", 1},
+		{1, 10, "0", 1},
+	} {
+		var annotations = map[string]string{}
+
+		if test.annotation != "" {
+			annotations[testMaxConcurrentAnnotation] = test.annotation
+		}
+
+		var ds = makeTestDaemonSet(test.pods, annotations)
+		lock, _ := makeTestLock("test", test.maxConcurrent, ds)
+
+		assert.Equalf(t, test.limit, lock.limit(ds), "limit for %#v", test)
+	}
+}
+
+func TestLockBusy(t *testing.T) {
+	var ds = makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation:          `{"holders":[{"node":"other1"},{"node":"other2"}]}`,
+		testMaxConcurrentAnnotation: "2",
+	})
+	var object = ds.DeepCopyObject()
+
+	lock, _ := makeTestLock("test", 1, ds)
+
+	value, available, acquired := lock.test(ds)
+	assert.Equal(t, "other1,other2", value)
+	assert.False(t, available, "available")
+	assert.False(t, acquired, "acquired")
+
+	assert.EqualError(t, lock.set(&object), "Busy lock: test/lock=other1,other2")
+}
+
+func TestLockTopology(t *testing.T) {
+	var ds = makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: `{"holders":[{"node":"other","domain":"zone1"}]}`,
+	})
+
+	var node = makeTestNodeObject("test", corev1.ConditionTrue)
+	node.Labels = map[string]string{"test/zone": "zone1"}
+
+	lock, client := makeTestLock("test", 2, ds)
+	lock.options.TopologyKey = "test/zone"
+
+	if err := client.tracker.Add(node); err != nil {
+		t.Fatalf("Add node: %v", err)
+	}
+
+	if domain, err := lock.getDomain(); assert.NoError(t, err, "getDomain") {
+		assert.Equal(t, "zone1", domain)
+
+		lock.domain = domain
+	}
+
+	var object = ds.DeepCopyObject()
+
+	_, available, _ := lock.test(ds)
+	assert.False(t, available, "available in same domain")
+	assert.EqualError(t, lock.set(&object), "Busy lock: test/lock=other in test/zone=zone1")
+
+	// relabeled node
+	node.Labels["test/zone"] = "zone2"
+
+	if _, err := lock.coreClient.Nodes().Update(node); err != nil {
+		t.Fatalf("Update node: %v", err)
+	}
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire in other domain")
+
+	if lockValue := getTestLockValue(t, lock); assert.Len(t, lockValue.Holders, 2) {
+		assert.Equal(t, "zone2", lockValue.Holders[1].Domain)
+	}
+
+	assert.NoError(t, lock.Release(), "Release")
+	assert.Equal(t, []string{"other"}, getTestLockValue(t, lock).Nodes())
+}
+
+// watches never see any events, and only time out
+func reactTestLockWatch(client testClient) {
+	client.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, watch.NewFake(), nil
+	})
+}
+
+func TestLockStaleDeleted(t *testing.T) {
+	lock, client := makeTestLock("test", 1, makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: `{"holders":[{"node":"other","token":1}],"token":1}`,
+	}))
+	lock.options.StaleTimeout = 10 * time.Minute
+
+	reactTestLockWatch(client)
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire")
+
+	if lockValue := getTestLockValue(t, lock); assert.Len(t, lockValue.Holders, 1) {
+		assert.Equal(t, "test", lockValue.Holders[0].Node)
+		assert.Equal(t, uint64(2), lockValue.Holders[0].Token)
+	}
+
+	if events, err := client.CoreV1().Events("kube-system").List(metav1.ListOptions{}); assert.NoError(t, err) && assert.Len(t, events.Items, 1) {
+		assert.Equal(t, "LockTakeover", events.Items[0].Reason)
+		assert.Equal(t, "host-upgrades", events.Items[0].InvolvedObject.Name)
+		assert.Contains(t, events.Items[0].Message, "stale holder other: node deleted")
+	}
+}
+
+func TestLockStaleNotReady(t *testing.T) {
+	var node = makeTestNodeObject("other", corev1.ConditionFalse)
+
+	node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-1 * time.Minute))
+
+	lock, client := makeTestLock("test", 1, makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: "other",
+	}))
+	lock.options.StaleTimeout = 10 * time.Minute
+
+	reactTestLockWatch(client)
+
+	assert.NoError(t, client.tracker.Add(node))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.Error(t, lock.Acquire(ctx), "Acquire with node recently NotReady")
+	assert.Equal(t, "other", getTestLockAnnotation(t, lock))
+
+	node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-1 * time.Hour))
+
+	_, err := client.CoreV1().Nodes().Update(node)
+	assert.NoError(t, err)
+
+	assert.NoError(t, lock.Acquire(context.Background()), "Acquire with node NotReady for longer than the stale timeout")
+	assert.Equal(t, []string{"test"}, getTestLockValue(t, lock).Nodes())
+}
+
+func TestLockStaleReady(t *testing.T) {
+	var ds = makeTestDaemonSet(3, map[string]string{
+		testLockAnnotation: "other",
+	})
+
+	lock, client := makeTestLock("test", 1, ds)
+	lock.options.StaleTimeout = 10 * time.Minute
+
+	assert.NoError(t, client.tracker.Add(makeTestNodeObject("other", corev1.ConditionTrue)))
+
+	broken, takeovers, err := lock.breakStale(ds)
+	assert.NoError(t, err)
+	assert.Nil(t, broken)
+	assert.Empty(t, takeovers)
+}
@@ -0,0 +1,142 @@
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type LockPhase string
+
+const (
+	LockPhaseUpgrading LockPhase = "upgrading"
+	LockPhaseDraining  LockPhase = "draining"
+	LockPhaseRebooting LockPhase = "rebooting"
+)
+
+type lockHolder struct {
+	Node       string    `json:"node"`
+	Domain     string    `json:"domain,omitempty"`
+	Pod        string    `json:"pod,omitempty"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	Phase      LockPhase `json:"phase,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Token      uint64    `json:"token,omitempty"`
+}
+
+// legacy holders do not have any acquiredAt/phase
+func (holder lockHolder) String() string {
+	if holder.AcquiredAt.IsZero() {
+		return holder.Node
+	} else {
+		return fmt.Sprintf("%v (%v for %v)", holder.Node, holder.Phase, time.Since(holder.AcquiredAt).Truncate(time.Second))
+	}
+}
+
+// Lock annotation value, with the set of lock holders
+//
+// The last issued fencing token is stored in a separate annotation, but is also read from legacy lock values.
+// Also accepts a legacy plain string value with a single holder node name.
+type lockValue struct {
+	Holders []lockHolder `json:"holders"`
+	Token   uint64       `json:"token,omitempty"`
+}
+
+func parseLockValue(value string) (lockValue, error) {
+	var lockValue lockValue
+
+	if value == "" {
+		return lockValue, nil
+	} else if !strings.HasPrefix(value, "{") {
+		lockValue.Holders = []lockHolder{{Node: value}}
+	} else if err := json.Unmarshal([]byte(value), &lockValue); err != nil {
+		return lockValue, fmt.Errorf("Invalid lock value %#v: %v", value, err)
+	}
+
+	return lockValue, nil
+}
+
+// returns an empty string if there are no holders, omitting the separately stored fencing token
+func (lockValue lockValue) String() string {
+	lockValue.Token = 0
+
+	if len(lockValue.Holders) == 0 {
+		return ""
+	} else if buf, err := json.Marshal(lockValue); err != nil {
+		panic(err)
+	} else {
+		return string(buf)
+	}
+}
+
+// holder node names, for logging
+func (lockValue lockValue) Nodes() []string {
+	var nodes = make([]string, len(lockValue.Holders))
+
+	for i, holder := range lockValue.Holders {
+		nodes[i] = holder.Node
+	}
+
+	return nodes
+}
+
+// holder details, for logging
+func (lockValue lockValue) Describe() string {
+	var holders = make([]string, len(lockValue.Holders))
+
+	for i, holder := range lockValue.Holders {
+		holders[i] = holder.String()
+	}
+
+	return strings.Join(holders, ", ")
+}
+
+func (lockValue lockValue) hasHolder(node string) bool {
+	return lockValue.getHolder(node) != nil
+}
+
+// returns a pointer for modifying the holder in place, or nil
+func (lockValue lockValue) getHolder(node string) *lockHolder {
+	for i := range lockValue.Holders {
+		if lockValue.Holders[i].Node == node {
+			return &lockValue.Holders[i]
+		}
+	}
+
+	return nil
+}
+
+// other holder within the same topology domain
+func (lockValue lockValue) domainHolder(domain string) (lockHolder, bool) {
+	for _, holder := range lockValue.Holders {
+		if holder.Domain == domain {
+			return holder, true
+		}
+	}
+
+	return lockHolder{}, false
+}
+
+// add holder with the next fencing token
+func (lockValue *lockValue) addHolder(holder lockHolder) lockHolder {
+	lockValue.Token++
+
+	holder.Token = lockValue.Token
+
+	lockValue.Holders = append(lockValue.Holders, holder)
+
+	return holder
+}
+
+func (lockValue *lockValue) removeHolder(node string) bool {
+	for i, holder := range lockValue.Holders {
+		if holder.Node == node {
+			lockValue.Holders = append(lockValue.Holders[:i], lockValue.Holders[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
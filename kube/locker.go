@@ -0,0 +1,28 @@
+package kube
+
+import (
+	"context"
+)
+
+// Cluster-wide upgrade lock
+type Locker interface {
+	String() string
+
+	// Test if the lock is held by this node, returning the current lock holder
+	Test() (value string, acquired bool, err error)
+
+	// Get the current lock holders, without logging
+	Holders() ([]string, error)
+
+	// Wait for the lock to be free, and acquire it
+	Acquire(ctx context.Context) error
+
+	// Closed if the acquired lock is lost to another holder, nil if the lock cannot be lost
+	Lost() <-chan struct{}
+
+	// Release the lock, failing if not held by this node
+	Release() error
+
+	// Update the phase recorded for the lock holder, if supported by the lock
+	SetPhase(phase LockPhase) error
+}
@@ -104,6 +104,16 @@ func (node *Node) InitCondition(conditionType corev1.NodeConditionType) error {
 	})
 }
 
+func (node *Node) GetLabel(label string) (string, bool, error) {
+	if obj, err := node.get(); err != nil {
+		return "", false, err
+	} else if value, exists := obj.ObjectMeta.Labels[label]; !exists {
+		return "", false, nil
+	} else {
+		return value, true, nil
+	}
+}
+
 func (node *Node) setAnnotation(obj *corev1.Node, annotation string, value string) {
 	if obj.ObjectMeta.Annotations == nil {
 		obj.ObjectMeta.Annotations = make(map[string]string)
@@ -134,6 +144,28 @@ func (node *Node) GetAnnotation(annotation string) (string, bool, error) {
 	}
 }
 
+// pick the set annotations, omitting any unset annotations
+func (node *Node) getAnnotations(obj *corev1.Node, annotations []string) map[string]string {
+	var values = make(map[string]string)
+
+	for _, annotation := range annotations {
+		if value, exists := node.getAnnotation(obj, annotation); exists {
+			values[annotation] = value
+		}
+	}
+
+	return values
+}
+
+// Returns the set annotations, omitting any unset annotations
+func (node *Node) GetAnnotations(annotations []string) (map[string]string, error) {
+	if obj, err := node.get(); err != nil {
+		return nil, err
+	} else {
+		return node.getAnnotations(obj, annotations), nil
+	}
+}
+
 func (node *Node) SetAnnotation(annotation string, value string) error {
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 		if obj, err := node.get(); err != nil {
@@ -162,6 +194,31 @@ func (node *Node) ClearAnnotation(annotation string) error {
 	})
 }
 
+// Clear the annotation if still set to the value, returning false if unset or changed
+func (node *Node) ClearAnnotationValue(annotation string, value string) (bool, error) {
+	var cleared bool
+
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if obj, err := node.get(); err != nil {
+			return err
+		} else if current, exists := node.getAnnotation(obj, annotation); !exists || current != value {
+			cleared = false
+
+			return nil
+		} else if node.clearAnnotation(obj, annotation); err != nil { // XXX: control flow hack, can't fail
+			return err
+		} else if _, err := node.client.Nodes().Update(obj); err != nil {
+			return err // unmodified for RetryOnConflict
+		} else {
+			cleared = true
+
+			return nil
+		}
+	})
+
+	return cleared, err
+}
+
 func (node *Node) SetUnschedulable(unschedulable bool) error {
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 		obj, err := node.get()
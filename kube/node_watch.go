@@ -0,0 +1,152 @@
+package kube
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// retry interval for failed node watches
+var nodeWatchRetryInterval = 10 * time.Second
+
+// node watches are restarted after the timeout, re-checking the node
+var nodeWatchTimeout = 1 * time.Minute
+
+func (node *Node) watch(resourceVersion string) (watch.Interface, error) {
+	var timeoutSeconds = int64(nodeWatchTimeout.Seconds())
+	var listOptions = metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", node.name).String(),
+		ResourceVersion: resourceVersion,
+		TimeoutSeconds:  &timeoutSeconds,
+	}
+
+	if watcher, err := node.client.Nodes().Watch(listOptions); err != nil {
+		return nil, fmt.Errorf("Watch %v: %v", node, err)
+	} else {
+		return watcher, nil
+	}
+}
+
+// check the node, and watch for changes until stopped or the watch times out
+func (node *Node) watchNode(stop <-chan struct{}, fn func(obj *corev1.Node) error) error {
+	obj, err := node.get()
+	if err != nil {
+		return err
+	} else if err := fn(obj); err != nil {
+		return err
+	}
+
+	watcher, err := node.watch(obj.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if obj, ok := event.Object.(*corev1.Node); !ok {
+					return fmt.Errorf("Unexpected watch object: %T", event.Object)
+				} else if err := fn(obj); err != nil {
+					return err
+				}
+			case watch.Error:
+				return fmt.Errorf("Watch %v: %v", node, errors.FromObject(event.Object))
+			}
+		}
+	}
+}
+
+// watch the node until stopped, retrying failed watches
+func (node *Node) watchNodeRetry(stop <-chan struct{}, name string, fn func(obj *corev1.Node) error) {
+	for {
+		if err := node.watchNode(stop, fn); err != nil {
+			log.Printf("kube/node %v: watch %v failed, retrying: %v", node, name, err)
+
+			select {
+			case <-stop:
+			case <-time.After(nodeWatchRetryInterval):
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// Watch the node for the annotation until stopped, calling fn with the annotation value
+//
+// The value is retried later if fn returns false. Once accepted, fn is not called again until the annotation is
+// cleared or changed. The annotation is left set, for the caller to clear.
+func (node *Node) WatchAnnotation(stop <-chan struct{}, annotation string, fn func(value string) bool) {
+	var accepted *string
+
+	node.watchNodeRetry(stop, annotation, func(obj *corev1.Node) error {
+		value, exists := node.getAnnotation(obj, annotation)
+
+		if !exists {
+			accepted = nil
+		} else if accepted != nil && *accepted == value {
+			return nil // already accepted
+		} else if !fn(value) {
+			log.Printf("kube/node %v: annotation %v=%v not accepted, will retry", node, annotation, value)
+		} else {
+			accepted = &value
+		}
+
+		return nil
+	})
+}
+
+func equalAnnotations(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, value := range a {
+		if other, exists := b[key]; !exists || other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Watch the node for changes to the annotations until stopped, calling fn with the initial and changed values
+//
+// Unset annotations are omitted from the values.
+func (node *Node) WatchAnnotations(stop <-chan struct{}, annotations []string, fn func(values map[string]string)) {
+	var current map[string]string
+
+	node.watchNodeRetry(stop, strings.Join(annotations, ","), func(obj *corev1.Node) error {
+		values := node.getAnnotations(obj, annotations)
+
+		if current != nil && equalAnnotations(current, values) {
+			return nil
+		}
+
+		current = values
+
+		fn(values)
+
+		return nil
+	})
+}
@@ -0,0 +1,175 @@
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func init() {
+	nodeWatchRetryInterval = 10 * time.Millisecond
+}
+
+func makeTestNodeWatch(client testClient) *watch.FakeWatcher {
+	var watcher = watch.NewFakeWithChanSize(10, false)
+
+	client.PrependWatchReactor("nodes", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, watcher, nil
+	})
+
+	return watcher
+}
+
+func getTestNodeAnnotation(t *testing.T, client testClient, annotation string) (string, bool) {
+	obj, err := client.CoreV1().Nodes().Get("test", metav1.GetOptions{})
+
+	assert.NoError(t, err)
+
+	value, exists := obj.Annotations[annotation]
+
+	return value, exists
+}
+
+func TestNodeWatchAnnotation(t *testing.T) {
+	var triggers = make(chan string, 10)
+	var stop = make(chan struct{})
+
+	node, client := makeTestNode()
+	watcher := makeTestNodeWatch(client)
+
+	go node.WatchAnnotation(stop, "test/trigger", func(value string) bool {
+		triggers <- value
+		return true
+	})
+	defer close(stop)
+
+	// triggered by a watch event
+	obj, err := client.CoreV1().Nodes().Get("test", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	obj.Annotations = map[string]string{"test/trigger": "now"}
+
+	_, err = client.CoreV1().Nodes().Update(obj)
+	assert.NoError(t, err)
+
+	watcher.Modify(obj)
+
+	select {
+	case value := <-triggers:
+		assert.Equal(t, "now", value)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timeout waiting for trigger")
+	}
+
+	// left set once accepted, and not triggered again for the same value
+	watcher.Modify(obj.DeepCopy())
+
+	select {
+	case value := <-triggers:
+		t.Fatalf("Unexpected re-trigger: %v", value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	value, exists := getTestNodeAnnotation(t, client, "test/trigger")
+	assert.True(t, exists, "annotation is left set once accepted")
+	assert.Equal(t, "now", value)
+
+	// triggered again once cleared and re-set
+	obj.Annotations = nil
+	watcher.Modify(obj.DeepCopy())
+
+	obj.Annotations = map[string]string{"test/trigger": "now"}
+	watcher.Modify(obj.DeepCopy())
+
+	select {
+	case value := <-triggers:
+		assert.Equal(t, "now", value)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timeout waiting for re-trigger")
+	}
+}
+
+func TestNodeClearAnnotationValue(t *testing.T) {
+	node, client := makeTestNode()
+
+	var obj = &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test",
+		Annotations: map[string]string{"test/trigger": "now"},
+	}}
+
+	_, err := client.CoreV1().Nodes().Update(obj)
+	assert.NoError(t, err)
+
+	cleared, err := node.ClearAnnotationValue("test/trigger", "other")
+	assert.NoError(t, err)
+	assert.False(t, cleared, "annotation is not cleared if changed")
+
+	value, exists := getTestNodeAnnotation(t, client, "test/trigger")
+	assert.True(t, exists, "annotation is not cleared if changed")
+	assert.Equal(t, "now", value)
+
+	cleared, err = node.ClearAnnotationValue("test/trigger", "now")
+	assert.NoError(t, err)
+	assert.True(t, cleared, "annotation is cleared if unchanged")
+
+	_, exists = getTestNodeAnnotation(t, client, "test/trigger")
+	assert.False(t, exists, "annotation is cleared if unchanged")
+
+	cleared, err = node.ClearAnnotationValue("test/trigger", "now")
+	assert.NoError(t, err)
+	assert.False(t, cleared, "annotation is not cleared if unset")
+}
+
+func TestNodeWatchAnnotations(t *testing.T) {
+	var changes = make(chan map[string]string, 10)
+	var stop = make(chan struct{})
+
+	node, client := makeTestNode()
+	watcher := makeTestNodeWatch(client)
+
+	go node.WatchAnnotations(stop, []string{"test/schedule", "test/window"}, func(values map[string]string) {
+		changes <- values
+	})
+	defer close(stop)
+
+	var waitChange = func() map[string]string {
+		select {
+		case values := <-changes:
+			return values
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timeout waiting for change")
+			return nil
+		}
+	}
+
+	// initial values
+	assert.Equal(t, map[string]string{}, waitChange())
+
+	obj, err := client.CoreV1().Nodes().Get("test", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// unrelated changes are ignored
+	obj.Annotations = map[string]string{"test/other": "foo"}
+	watcher.Modify(obj.DeepCopy())
+
+	obj.Annotations = map[string]string{"test/other": "foo", "test/schedule": "0 3 * * *"}
+	watcher.Modify(obj.DeepCopy())
+
+	assert.Equal(t, map[string]string{"test/schedule": "0 3 * * *"}, waitChange())
+
+	obj.Annotations = map[string]string{"test/window": "2h"}
+	watcher.Modify(obj.DeepCopy())
+
+	assert.Equal(t, map[string]string{"test/window": "2h"}, waitChange())
+
+	select {
+	case values := <-changes:
+		t.Errorf("Unexpected change: %v", values)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
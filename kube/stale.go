@@ -0,0 +1,40 @@
+package kube
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// test if a lock holder node has been deleted, or has been NotReady for longer than the threshold
+func testStaleNode(client corev1client.CoreV1Interface, name string, threshold time.Duration) (stale bool, reason string, err error) {
+	obj, err := client.Nodes().Get(name, metav1.GetOptions{})
+	if err != nil && errors.IsNotFound(err) {
+		return true, "node deleted", nil
+	} else if err != nil {
+		return false, "", fmt.Errorf("Get node %v: %v", name, err)
+	}
+
+	// nodes without any Ready condition have never been ready
+	var notReadySince = obj.CreationTimestamp.Time
+
+	for _, condition := range obj.Status.Conditions {
+		if condition.Type != corev1.NodeReady {
+			continue
+		} else if condition.Status == corev1.ConditionTrue {
+			return false, "", nil
+		} else {
+			notReadySince = condition.LastTransitionTime.Time
+		}
+	}
+
+	if notReady := time.Since(notReadySince); notReady < threshold {
+		return false, "", nil
+	} else {
+		return true, fmt.Sprintf("node not ready for %v", notReady.Truncate(time.Second)), nil
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/kontena/pharos-host-upgrades/hosts"
+	"github.com/kontena/pharos-host-upgrades/systemd"
 )
 
 const UpgradeConditionType corev1.NodeConditionType = "HostUpgrades"
@@ -36,13 +39,54 @@ func MakeUpgradeCondition(status hosts.Status, err error) corev1.NodeCondition {
 	return condition
 }
 
+// upgrades were skipped, the host may or may not be up to date
+func MakeUpgradeConditionPaused(reason string) corev1.NodeCondition {
+	var condition = corev1.NodeCondition{
+		Type:               UpgradeConditionType,
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+	}
+
+	condition.Status = corev1.ConditionUnknown
+	condition.Reason = "Paused"
+	condition.Message = reason
+
+	return condition
+}
+
+// the run attempt failed, and may be retried
+func MakeUpgradeConditionFailed(attempt int, attempts int, err error, retryTime time.Time) corev1.NodeCondition {
+	var condition = corev1.NodeCondition{
+		Type:               UpgradeConditionType,
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+	}
+
+	condition.Status = corev1.ConditionUnknown
+
+	if retryTime.IsZero() {
+		condition.Reason = "UpgradeFailed"
+		condition.Message = fmt.Sprintf("Attempt %d/%d failed: %v", attempt, attempts, err)
+	} else {
+		condition.Reason = "UpgradeRetrying"
+		condition.Message = fmt.Sprintf("Attempt %d/%d failed, retrying at %v: %v", attempt, attempts, retryTime.Format(time.RFC3339), err)
+	}
+
+	return condition
+}
+
 func MakeRebootCondition(info hosts.Info, status hosts.Status, upgradeErr error) corev1.NodeCondition {
 	var condition = corev1.NodeCondition{
 		Type:              RebootConditionType,
 		LastHeartbeatTime: metav1.Now(),
 	}
 
-	if status.RebootRequired {
+	if status.RebootRequired && status.RebootRequiredReason != "" {
+		condition.Status = corev1.ConditionTrue
+		condition.LastTransitionTime = metav1.NewTime(status.RebootRequiredSince)
+		condition.Reason = status.RebootRequiredReason
+		condition.Message = status.RebootRequiredMessage
+	} else if status.RebootRequired {
 		condition.Status = corev1.ConditionTrue
 		condition.LastTransitionTime = metav1.NewTime(status.RebootRequiredSince)
 		condition.Reason = "RebootRequired"
@@ -61,6 +105,56 @@ func MakeRebootCondition(info hosts.Info, status hosts.Status, upgradeErr error)
 	return condition
 }
 
+// reboot is required, but postponed until the next --reboot-schedule
+func MakeRebootConditionPending(status hosts.Status, rebootTime time.Time) corev1.NodeCondition {
+	var condition = corev1.NodeCondition{
+		Type:              RebootConditionType,
+		LastHeartbeatTime: metav1.Now(),
+	}
+
+	condition.Status = corev1.ConditionTrue
+	condition.LastTransitionTime = metav1.NewTime(status.RebootRequiredSince)
+	condition.Reason = "RebootPending"
+	condition.Message = fmt.Sprintf("Reboot scheduled at %v: %v", rebootTime.Format(time.RFC3339), status.RebootRequiredMessage)
+
+	return condition
+}
+
+// reboot is required, but waiting for host shutdown inhibitor locks to be released
+func MakeRebootConditionInhibited(inhibitors []systemd.Inhibitor, inhibitTime time.Time, deadline time.Time) corev1.NodeCondition {
+	var condition = corev1.NodeCondition{
+		Type:              RebootConditionType,
+		LastHeartbeatTime: metav1.Now(),
+	}
+	var inhibitedBy []string
+
+	for _, inhibitor := range inhibitors {
+		inhibitedBy = append(inhibitedBy, inhibitor.String())
+	}
+
+	condition.Status = corev1.ConditionTrue
+	condition.LastTransitionTime = metav1.NewTime(inhibitTime)
+	condition.Reason = "RebootInhibited"
+	condition.Message = fmt.Sprintf("Reboot inhibited until at most %v by: %v", deadline.Format(time.RFC3339), strings.Join(inhibitedBy, ", "))
+
+	return condition
+}
+
+// the reboot sequence was rolled back, and the host still requires a reboot
+func MakeRebootConditionFailed(err error) corev1.NodeCondition {
+	var condition = corev1.NodeCondition{
+		Type:               RebootConditionType,
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+	}
+
+	condition.Status = corev1.ConditionTrue
+	condition.Reason = "RebootFailed"
+	condition.Message = err.Error()
+
+	return condition
+}
+
 func MakeRebootConditionRebooting(rebootTime time.Time) corev1.NodeCondition {
 	var condition = corev1.NodeCondition{
 		Type:              RebootConditionType,
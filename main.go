@@ -7,23 +7,53 @@ import (
 	"log"
 	"os"
 	"time"
+
+	"github.com/kontena/pharos-host-upgrades/kube"
+	"github.com/kontena/pharos-host-upgrades/systemd"
 )
 
 const DefaultRebootTimeout = 5 * time.Minute
+const DefaultRebootAttempts = 3
+const DefaultRebootInhibitTimeout = 1 * time.Hour
+const RebootInhibitInterval = 30 * time.Second
 const DefaultScheduleWindow = 1 * time.Hour
+const DefaultRebootWindow = 1 * time.Hour
 
 type Options struct {
-	ConfigPath     string
-	HostMount      string
-	Schedule       string
-	ScheduleWindow time.Duration
-	Reboot         bool
-	RebootTimeout  time.Duration
-	Drain          bool
-	Kube           KubeOptions
+	ConfigPath           string
+	HostMount            string
+	StatePath            string
+	Schedule             string
+	ScheduleWindow       time.Duration
+	ScheduleSplay        time.Duration
+	ScheduleTimezone     string
+	ScheduleAttempts     int
+	ScheduleBackoff      time.Duration
+	Reboot               bool
+	RebootTimeout        time.Duration
+	RebootAttempts       int
+	RebootInhibitTimeout time.Duration
+	RebootSchedule       string
+	RebootWindow         time.Duration
+	MaxRebootPending     time.Duration
+	MaxUptime            time.Duration
+	Drain                bool
+	MetricsListen        string
+	HealthMargin         time.Duration
+	HealthRunTimeout     time.Duration
+	Kube                 KubeOptions
 }
 
 func run(options Options) error {
+	if options.RebootAttempts < 1 {
+		return fmt.Errorf("Invalid --reboot-attempts=%v: must be at least 1", options.RebootAttempts)
+	}
+
+	// truncated to whole seconds, where zero would force immediate deletion
+	if gracePeriod := options.Kube.DrainOptions.GracePeriod; gracePeriod > 0 && gracePeriod < time.Second {
+		return fmt.Errorf("Invalid --drain-grace-period=%v: must be at least 1s, or negative to use the pod default", gracePeriod)
+	}
+
 	config, err := loadConfig(options)
 	if err != nil {
 		return fmt.Errorf("Failed to load config: %v", err)
@@ -38,17 +68,56 @@ func run(options Options) error {
 		return fmt.Errorf("Failed to configure host: %v", err)
 	}
 
-	scheduler, err := makeScheduler(options)
+	health := makeHealth(options)
+
+	metrics, err := makeMetrics(options, health)
+	if err != nil {
+		return err
+	}
+
+	blackout, err := loadBlackout(config)
+	if err != nil {
+		return fmt.Errorf("Failed to load blackout calendar: %v", err)
+	}
+
+	state, err := loadState(options)
+	if err != nil {
+		return err
+	}
+
+	scheduler, err := makeScheduler(options, blackout, state, metrics, health)
 	if err != nil {
 		return err
 	}
 
+	rebootState, err := loadRebootState(config)
+	if err != nil {
+		return fmt.Errorf("Failed to load reboot state: %v", err)
+	}
+
 	// kube is optional, this will be nil if not configured; the methods are no-op when called on nil
-	kube, err := makeKube(options, hostInfo)
+	kube, err := makeKube(options, hostInfo, rebootState)
 	if err != nil {
 		return fmt.Errorf("Failed to initialize kube: %v", err)
 	}
 
+	// any interrupted reboot sequence was resumed or rolled back
+	rebootState.Clear()
+
+	kube.WatchLockHolders(metrics.SetLockHolders)
+
+	// per-node schedule annotations override the --schedule and --schedule-window options
+	if err := kube.WatchSchedule(options.Schedule, options.ScheduleWindow, scheduler.Update); err != nil {
+		return fmt.Errorf("Failed to initialize kube schedule: %v", err)
+	}
+
+	// kube startup recovery is complete
+	health.SetReady()
+
+	kube.WatchTrigger(scheduler.Trigger)
+
+	scheduler.OnFailure(kube.UpdateFailedStatus)
+
 	if options.Reboot && options.Drain {
 		log.Printf("Using --reboot --drain, will drain kube node and reboot host after upgrades if required")
 	} else if options.Reboot {
@@ -57,90 +126,363 @@ func run(options Options) error {
 		log.Printf("Skipping host reboot after upgrades")
 	}
 
-	return scheduler.Run(func(ctx context.Context) error {
-		if err := kube.AcquireLock(ctx); err != nil {
-			return fmt.Errorf("Failed to acquire kube lock: %v", err)
+	// rolls back the reboot sequence, the node must still be undrained and the lock released
+	var abortReboot = func(err error) {
+		if rebootErr := kube.RebootFailed(err); rebootErr != nil {
+			log.Printf("%v", rebootErr)
 		}
 
-		// runs with the kube lock held
-		rebooting, err := func() (bool, error) {
-			log.Printf("Running host upgrades...")
+		rebootState.Clear()
+	}
 
-			status, err := host.Upgrade()
+	// returns an error if the host shutdown is still inhibited after the --reboot-inhibit-timeout
+	var waitInhibitors = func(ctx context.Context) error {
+		var inhibitTime = time.Now()
+		var deadline = inhibitTime.Add(options.RebootInhibitTimeout)
+		var inhibitedBy string
 
+		for {
+			inhibitors, err := systemd.ListShutdownInhibitors()
 			if err != nil {
-				kube.UpdateHostStatus(status, err)
+				return fmt.Errorf("Failed to list host shutdown inhibitors: %v", err)
+			} else if len(inhibitors) == 0 {
+				return nil
+			} else if !time.Now().Before(deadline) {
+				return fmt.Errorf("Host shutdown inhibited for more than --reboot-inhibit-timeout=%v by: %v", options.RebootInhibitTimeout, inhibitors)
+			} else if fmt.Sprintf("%v", inhibitors) != inhibitedBy {
+				if err := kube.MarkRebootInhibited(inhibitors, inhibitTime, deadline); err != nil {
+					log.Printf("%v", err)
+				} else {
+					inhibitedBy = fmt.Sprintf("%v", inhibitors)
 
-				return false, err
+					log.Printf("Host shutdown inhibited by %v, waiting until at most %v...", inhibitedBy, deadline)
+				}
 			}
 
-			if err := kube.UpdateHostStatus(status, err); err != nil {
-				return false, fmt.Errorf("Kube node status update failed: %v", err)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("Host shutdown inhibited by %v: %v", inhibitors, ctx.Err())
+			case <-time.After(RebootInhibitInterval):
 			}
+		}
+	}
 
-			if options.Reboot && status.RebootRequired {
-				if !options.Drain {
-					log.Printf("Reboot required, rebooting without draining kube node...")
-				} else {
-					log.Printf("Reboot required, draining kube node...")
+	// reboots the host, retrying until the host shutdown starts
+	var waitReboot = func() error {
+		watcher, err := systemd.WatchShutdown()
+		if err != nil {
+			log.Printf("Unable to watch for host shutdown, waiting for termination: %v", err)
 
-					if err := kube.DrainNode(); err != nil {
-						// XXX: bad idea to release the lock with the node drained?
-						return false, fmt.Errorf("Failed to drain kube node for host reboot: %v", err)
-					} else if err := kube.MarkReboot(time.Now()); err != nil {
-						// XXX: bad idea to release the lock with the node drained?
-						return false, fmt.Errorf("Failed to mark kube node for host reboot: %v", err)
-					}
+			if err := host.Reboot(); err != nil {
+				return err
+			}
 
-					log.Printf("Rebooting...")
-				}
+			// wait for systemd shutdown => docker terminate to kill us
+			time.Sleep(options.RebootTimeout)
 
-				if err := host.Reboot(); err != nil {
-					// XXX: will enter a fail-loop while drained after restarting due to kube node reboot state if unable to reboot
-					// XXX: bad idea to release the lock with the node drained?
-					return false, fmt.Errorf("Failed to reboot host: %v", err)
-				}
+			return fmt.Errorf("Timeout waiting for host to shutdown")
+		}
+		defer watcher.Close()
+
+		for attempt := 1; attempt <= options.RebootAttempts; attempt++ {
+			// logind lets root reboot through block inhibitors, which may have been taken while draining
+			if inhibitors, err := systemd.ListShutdownInhibitors(); err != nil {
+				return fmt.Errorf("Failed to list host shutdown inhibitors: %v", err)
+			} else if len(inhibitors) > 0 {
+				return fmt.Errorf("Host shutdown inhibited by: %v", inhibitors)
+			} else if err := host.Reboot(); err != nil {
+				return err
+			} else if watcher.Wait(options.RebootTimeout) {
+				return nil
+			} else {
+				log.Printf("Host shutdown did not start within --reboot-timeout=%v (attempt %d/%d)", options.RebootTimeout, attempt, options.RebootAttempts)
+			}
+		}
 
-				log.Printf("Host is shutting down...")
+		return fmt.Errorf("Host shutdown did not start after %d attempts", options.RebootAttempts)
+	}
 
-				return true, nil // do not release kube lock
+	// drains the kube node and reboots the host, returning once the host is shutting down
+	var rebootHost = func(ctx context.Context, drain bool, drained *bool) error {
+		// never drain the node if the host cannot be rebooted
+		if err := waitInhibitors(ctx); err != nil {
+			abortReboot(err)
 
-			} else if status.RebootRequired {
-				log.Printf("Reboot required, but skipping without --reboot")
+			return fmt.Errorf("Failed to reboot host: %v", err)
+		}
 
-			} else {
-				log.Printf("No reboot required")
+		if err := ctx.Err(); err != nil {
+			abortReboot(err)
+
+			return fmt.Errorf("Aborted host reboot before draining: %v", err)
+		}
+
+		if !drain {
+			log.Printf("Reboot required, rebooting without draining kube node...")
+		} else {
+			log.Printf("Reboot required, draining kube node...")
+
+			rebootState.Set(RebootPhaseDraining, hostInfo.BootID)
+
+			if err := kube.MarkReboot(RebootPhaseDraining, time.Now()); err != nil {
+				abortReboot(err)
+
+				return fmt.Errorf("Failed to mark kube node for draining: %v", err)
 			}
 
-			return false, nil
-		}()
+			*drained = true
 
-		// either release lock, or wait for reboot to happen
-		if err != nil {
-			log.Printf("Upgrade failed, releasing kube lock... (%v)", err)
+			var drainTime = time.Now()
+			var drainErr = kube.DrainNode(ctx)
 
-			if lockErr := kube.ReleaseLock(); lockErr != nil {
-				log.Printf("Failed to release kube lock: %v", lockErr)
+			metrics.RunPhase(MetricsPhaseDrain, drainTime, drainErr)
+
+			if drainErr != nil {
+				abortReboot(drainErr)
+
+				return fmt.Errorf("Failed to drain kube node for host reboot: %v", drainErr)
 			}
 
+			log.Printf("Rebooting...")
+		}
+
+		if err := ctx.Err(); err != nil {
+			abortReboot(err)
+
+			return fmt.Errorf("Aborted host reboot: %v", err)
+		}
+
+		// waiting for inhibitors and draining may have taken us into a blackout period
+		if period, active := blackout.Check(time.Now()); active {
+			var err = fmt.Errorf("Host reboot not allowed during blackout period %v, next allowed at %v", period, blackout.NextAllowed(time.Now()))
+
+			abortReboot(err)
+
 			return err
+		}
+
+		rebootState.Set(RebootPhaseRebooting, hostInfo.BootID)
+
+		if err := kube.MarkReboot(RebootPhaseRebooting, time.Now()); err != nil {
+			abortReboot(err)
+
+			return fmt.Errorf("Failed to mark kube node for host reboot: %v", err)
+		}
+
+		var rebootTime = time.Now()
+		var rebootErr = waitReboot()
+
+		metrics.RunPhase(MetricsPhaseReboot, rebootTime, rebootErr)
+
+		if rebootErr != nil {
+			abortReboot(rebootErr)
+
+			return PermanentError{fmt.Errorf("Failed to reboot host: %v", rebootErr)}
+		}
+
+		log.Printf("Host is shutting down...")
+
+		return nil
+	}
+
+	// runs f with the kube lock held, f returns true once the host is shutting down, leaving the lock held
+	var runLocked = func(ctx context.Context, f func(ctx context.Context, drained *bool) (bool, error)) error {
+		var lockTime = time.Now()
+
+		acquired, err := kube.AcquireLock(ctx)
+
+		if pausedErr, ok := err.(PausedError); ok {
+			log.Printf("Skipping paused upgrade: %v", pausedErr)
+
+			return kube.UpdatePausedStatus(pausedErr.Reason)
+		} else if err != nil {
+			metrics.RunPhase(MetricsPhaseLock, lockTime, err)
+
+			return fmt.Errorf("Failed to acquire kube lock: %v", err)
+		}
+
+		metrics.RunPhase(MetricsPhaseLock, lockTime, nil)
+		metrics.SetLockHeld(acquired)
+
+		// abort the run before draining or rebooting if the kube lock is lost
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func(lost <-chan struct{}) {
+			select {
+			case <-lost:
+				log.Printf("Lost kube lock, aborting run...")
+
+				cancel()
+			case <-ctx.Done():
+			}
+		}(kube.LockLost())
+
+		// set once the node may have been cordoned, and must be undrained before releasing the lock
+		var drained bool
+
+		rebooting, err := f(ctx, &drained)
+
+		if err == nil && rebooting {
+			var timeout = options.RebootTimeout * time.Duration(options.RebootAttempts)
 
-		} else if rebooting {
 			log.Printf("Leaving kube lock held for reboot, waiting for termination...")
 
-			// wait for systemd shutdown => docker terminate to kill us
-			time.Sleep(options.RebootTimeout)
+			// the host shutdown has started, wait for systemd shutdown => docker terminate to kill us
+			select {
+			case <-ctx.Done():
+				log.Fatalf("Host shutdown did not terminate us before the run was aborted, exiting for recovery: %v", ctx.Err())
+			case <-time.After(timeout):
+				log.Fatalf("Host shutdown did not terminate us within %v, exiting for recovery", timeout)
+			}
+		}
 
-			return fmt.Errorf("Timeout waiting for host to shutdown")
+		// the lock is left held if the node is still drained, and rolled back once restarted
+		if err != nil && drained {
+			log.Printf("Run failed, undraining kube node... (%v)", err)
+
+			if drainErr := kube.UndrainNode(); drainErr != nil {
+				log.Printf("Failed to undrain kube node, leaving kube lock held: %v", drainErr)
+
+				return err
+			}
+		}
+
+		// either release lock, or wait for reboot to happen
+		if err != nil {
+			log.Printf("Run failed, releasing kube lock... (%v)", err)
+
+			if lockErr := kube.ReleaseLock(); lockErr != nil {
+				log.Printf("Failed to release kube lock: %v", lockErr)
+			} else {
+				metrics.SetLockHeld(false)
+			}
+
+			return err
 
 		} else if err := kube.ReleaseLock(); err != nil {
 			return fmt.Errorf("Failed to release kube lock: %v", err)
 
 		} else {
+			metrics.SetLockHeld(false)
+
 			log.Printf("Done")
 		}
 
 		return nil
+	}
+
+	// the scheduled reboot is forced if postponed for the --max-uptime, which always drains
+	scheduler.OnReboot(func(ctx context.Context, force bool) error {
+		return runLocked(ctx, func(ctx context.Context, drained *bool) (bool, error) {
+			log.Printf("Running scheduled host reboot...")
+
+			// the reboot may no longer be required since it was scheduled, unless forced
+			if !force {
+				if status, err := host.Status(); err != nil {
+					return false, fmt.Errorf("Failed to query host status: %v", err)
+				} else if !status.RebootRequired {
+					log.Printf("Reboot no longer required, skipping scheduled reboot")
+
+					metrics.UpdateRebootStatus(status)
+
+					return false, kube.UpdateRebootStatus(status)
+				}
+			}
+
+			if err := rebootHost(ctx, options.Drain || (force && kube != nil), drained); err != nil {
+				return false, err
+			}
+
+			return true, nil // do not release kube lock
+		})
+	})
+
+	return scheduler.Run(func(ctx context.Context) error {
+		return runLocked(ctx, func(ctx context.Context, drained *bool) (bool, error) {
+			log.Printf("Running host upgrades...")
+
+			kube.StartUpgrade()
+
+			var upgradeTime = time.Now()
+
+			status, err := host.Upgrade()
+
+			metrics.RunPhase(MetricsPhaseUpgrade, upgradeTime, err)
+
+			if err != nil {
+				kube.UpdateHostStatus(status, err)
+
+				return false, err
+			}
+
+			// reboot even without --reboot, using the --reboot-schedule if any
+			var uptimeExceeded = options.MaxUptime != 0 && !hostInfo.BootTime.IsZero() && time.Since(hostInfo.BootTime) >= options.MaxUptime
+
+			if uptimeExceeded && !status.RebootRequired {
+				log.Printf("Host booted at %v, exceeding --max-uptime=%v, reboot required", hostInfo.BootTime, options.MaxUptime)
+
+				status.RebootRequired = true
+				status.RebootRequiredSince = hostInfo.BootTime.Add(options.MaxUptime)
+				status.RebootRequiredReason = "MaxUptimeExceeded"
+				status.RebootRequiredMessage = fmt.Sprintf("Host booted at %v, exceeding the maximum uptime of %v", hostInfo.BootTime.Format(time.RFC3339), options.MaxUptime)
+			}
+
+			metrics.UpdateHostStatus(status)
+
+			if err := state.SetLastRun(upgradeTime); err != nil {
+				log.Printf("%v", err)
+			}
+
+			if err := kube.UpdateHostStatus(status, err); err != nil {
+				return false, fmt.Errorf("Kube node status update failed: %v", err)
+			}
+
+			// forced reboot, even without --reboot or outside of the --reboot-schedule, unless the host does not report since when the reboot was required
+			var rebootOverdue = options.MaxRebootPending != 0 && status.RebootRequired && !status.RebootRequiredSince.IsZero() && time.Since(status.RebootRequiredSince) >= options.MaxRebootPending
+
+			if period, active := blackout.Check(time.Now()); (options.Reboot || rebootOverdue || uptimeExceeded) && status.RebootRequired && active {
+				log.Printf("Reboot required, but skipping during blackout period %v, next allowed at %v", period, blackout.NextAllowed(time.Now()))
+
+			} else if rebootOverdue {
+				var pending = time.Since(status.RebootRequiredSince)
+
+				log.Printf("Reboot required since %v, exceeding --max-reboot-pending=%v, forcing reboot...", status.RebootRequiredSince, options.MaxRebootPending)
+
+				kube.WarnRebootOverdue(pending, options.MaxRebootPending)
+
+				// always drains, unless there is no kube node to drain
+				if err := rebootHost(ctx, kube != nil, drained); err != nil {
+					return false, err
+				}
+
+				return true, nil // do not release kube lock
+
+			} else if (options.Reboot || uptimeExceeded) && status.RebootRequired && !scheduler.RebootAllowed(time.Now()) {
+				var rebootTime = scheduler.ScheduleReboot(uptimeExceeded)
+
+				log.Printf("Reboot required, but pending until the next --reboot-schedule at %v", rebootTime)
+
+				if err := kube.MarkRebootPending(status, rebootTime); err != nil {
+					return false, err
+				}
+
+			} else if (options.Reboot || uptimeExceeded) && status.RebootRequired {
+				if err := rebootHost(ctx, options.Drain || (uptimeExceeded && kube != nil), drained); err != nil {
+					return false, err
+				}
+
+				return true, nil // do not release kube lock
+
+			} else if status.RebootRequired {
+				log.Printf("Reboot required, but skipping without --reboot")
+
+			} else {
+				log.Printf("No reboot required")
+			}
+
+			return false, nil
+		})
 	})
 }
 
@@ -152,15 +494,42 @@ func main() {
 
 	flag.StringVar(&options.ConfigPath, "config-path", "/etc/host-upgrades", "Path to configmap dir")
 	flag.StringVar(&options.HostMount, "host-mount", "/run/host-upgrades", "Path to shared mount with host. Must be under /run to reset when rebooting!")
+	flag.StringVar(&options.StatePath, "state-path", "/var/lib/host-upgrades", "Path to persistent state dir, skipped if not existing. Must not be under /run to persist across reboots!")
 	flag.StringVar(&options.Schedule, "schedule", "", "Scheduled upgrade (cron syntax)")
 	flag.DurationVar(&options.ScheduleWindow, "schedule-window", DefaultScheduleWindow, "Set a deadline for the scheduled upgrade to start (duration syntax)")
+	flag.DurationVar(&options.ScheduleSplay, "schedule-splay", 0, "Delay each scheduled upgrade by a stable per-node offset within the splay, hashed from the node name (duration syntax)")
+	flag.IntVar(&options.ScheduleAttempts, "schedule-attempts", DefaultScheduleAttempts, "Retry failed upgrades within the --schedule-window, up to the maximum number of attempts")
+	flag.DurationVar(&options.ScheduleBackoff, "schedule-backoff", DefaultScheduleBackoff, "Initial delay before retrying a failed upgrade, doubled for each attempt")
+	flag.StringVar(&options.ScheduleTimezone, "schedule-timezone", "", "Time zone for the --schedule, e.g. Europe/Helsinki, or \"host\" to use the host time zone from systemd-timedated (default local time)")
 	flag.BoolVar(&options.Reboot, "reboot", false, "Reboot if required")
 	flag.DurationVar(&options.RebootTimeout, "reboot-timeout", DefaultRebootTimeout, "Wait for system to shutdown when rebooting")
+	flag.DurationVar(&options.RebootInhibitTimeout, "reboot-inhibit-timeout", DefaultRebootInhibitTimeout, "Wait for any host shutdown inhibitor locks to be released before draining for reboot")
+	flag.IntVar(&options.RebootAttempts, "reboot-attempts", DefaultRebootAttempts, "Retry the reboot if the host shutdown does not start within the --reboot-timeout, before rolling back")
+	flag.StringVar(&options.RebootSchedule, "reboot-schedule", "", "Only reboot within the --reboot-window from the scheduled time (cron syntax), otherwise reboot at the next scheduled time")
+	flag.DurationVar(&options.RebootWindow, "reboot-window", DefaultRebootWindow, "Set a deadline for the scheduled reboot (duration syntax)")
+	flag.StringVar(&options.MetricsListen, "metrics-listen", "", "Serve Prometheus metrics at /metrics and health checks at /healthz, /readyz on the given HTTP listen address, e.g. :9110")
+	flag.DurationVar(&options.HealthMargin, "health-margin", DefaultHealthMargin, "Fail the /healthz check once a run exceeds the --schedule-window and --reboot-timeout by this margin")
+	flag.DurationVar(&options.HealthRunTimeout, "health-run-timeout", DefaultHealthRunTimeout, "Fail the /healthz check once a run without a --schedule-window exceeds this duration, plus the --health-margin")
+	flag.DurationVar(&options.MaxRebootPending, "max-reboot-pending", 0, "Force a drain and reboot once a reboot has been required for longer than the duration, even without --reboot or outside of the --reboot-schedule, zero to disable")
+	flag.DurationVar(&options.MaxUptime, "max-uptime", 0, "Drain and reboot once the host has been up for longer than the duration, even without --reboot, using any --reboot-schedule, zero to disable")
 	flag.BoolVar(&options.Drain, "drain", false, "Drain kube node before reboot, uncordon after reboot")
+	flag.DurationVar(&options.Kube.DrainOptions.GracePeriod, "drain-grace-period", -1*time.Second, "Termination grace period for drained pods, negative to use the pod default")
+	flag.DurationVar(&options.Kube.DrainOptions.Timeout, "drain-timeout", kube.DefaultDrainTimeout, "Fail the drain if not completed within the timeout, zero for none")
+	flag.DurationVar(&options.Kube.DrainOptions.PodTimeout, "drain-pod-timeout", kube.DefaultDrainPodTimeout, "Fail the drain if any pod is not evicted within the timeout, zero for none")
+	flag.BoolVar(&options.Kube.DrainOptions.DeleteLocalData, "drain-delete-local-data", true, "Drain pods using emptyDir volumes, deleting any local data")
+	flag.BoolVar(&options.Kube.DrainOptions.Force, "drain-force", true, "Drain pods not managed by a controller, deleting them")
+	flag.StringVar(&options.Kube.DrainSkipSelector, "drain-skip-selector", "", "Do not drain pods matching the label selector")
+	flag.StringVar(&options.Kube.DrainWaitSelector, "drain-wait-selector", "", "Wait for pods matching the label selector to terminate, without evicting them")
 
 	flag.StringVar(&options.Kube.Namespace, "kube-namespace", os.Getenv("KUBE_NAMESPACE"), "Name of kube Namespace (KUBE_NAMESPACE)")
 	flag.StringVar(&options.Kube.DaemonSet, "kube-daemonset", os.Getenv("KUBE_DAEMONSET"), "Name of kube DaemonSet (KUBE_DAEMONSET)")
 	flag.StringVar(&options.Kube.Node, "kube-node", os.Getenv("KUBE_NODE"), "Name of kube Node (KUBE_NODE)")
+	flag.StringVar(&options.Kube.Pod, "kube-pod", os.Getenv("KUBE_POD"), "Name of kube Pod (KUBE_POD), recorded in the kube lock")
+	flag.StringVar(&options.Kube.LockBackend, "lock-backend", KubeLockBackendAnnotation, "Kube lock implementation: annotation (on the DaemonSet) or lease (coordination.k8s.io Lease, requires kube 1.12+)")
+	flag.StringVar(&options.Kube.MaxConcurrent, "max-concurrent", "1", "Maximum number of hosts upgrading concurrently, as a number or percentage of DaemonSet pods (overridden by the "+KubeMaxConcurrentAnnotation+" DaemonSet annotation)")
+	flag.StringVar(&options.Kube.TopologyKey, "lock-topology-key", "", "Allow at most one host upgrading concurrently per node label value, e.g. topology.kubernetes.io/zone (requires --lock-backend=annotation)")
+	flag.DurationVar(&options.Kube.StaleTimeout, "lock-stale-timeout", 0, "Take over the kube lock from holders whose node is deleted, or NotReady for longer than the timeout, zero to disable (requires --lock-backend=annotation)")
+	flag.DurationVar(&options.Kube.LeaseDuration, "lock-lease-duration", kube.DefaultLeaseDuration, "Kube lock lease duration, for --lock-backend=lease")
 	flag.Parse()
 
 	log.Printf("pharos-host-upgrades version %v (Go %v)", Version, GoVersion)
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/kontena/pharos-host-upgrades/hosts"
+)
+
+const MetricsNamespace = "pharos_host_upgrades"
+
+// run phases, used for the phase metric labels
+const (
+	MetricsPhaseRun     = "run"
+	MetricsPhaseLock    = "lock"
+	MetricsPhaseUpgrade = "upgrade"
+	MetricsPhaseDrain   = "drain"
+	MetricsPhaseReboot  = "reboot"
+)
+
+// Prometheus metrics, served on the optional --metrics-listen address, together with the health checks
+//
+// The metrics are always collected, even if not served.
+type Metrics struct {
+	registry *prometheus.Registry
+	mux      *http.ServeMux
+
+	phaseTimestamp *prometheus.GaugeVec
+	phaseSuccess   *prometheus.GaugeVec
+	phaseDuration  *prometheus.GaugeVec
+
+	upgradePackages prometheus.Gauge
+	rebootRequired  prometheus.Gauge
+	lockHeld        prometheus.Gauge
+	nextRun         prometheus.Gauge
+	lockHolder      *prometheus.GaugeVec
+
+	mutex               sync.Mutex
+	rebootRequiredSince time.Time
+}
+
+func makeMetrics(options Options, health *Health) (*Metrics, error) {
+	var metrics = Metrics{
+		registry: prometheus.NewRegistry(),
+		mux:      http.NewServeMux(),
+
+		phaseTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time of the last completed run phase",
+		}, []string{"phase"}),
+		phaseSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "last_run_success",
+			Help:      "Result of the last completed run phase, 1 if successful and 0 if failed",
+		}, []string{"phase"}),
+		phaseDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "last_run_duration_seconds",
+			Help:      "Duration of the last completed run phase, including any wait for the lock",
+		}, []string{"phase"}),
+
+		upgradePackages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "upgrade_packages",
+			Help:      "Number of packages upgraded by the last successful upgrade",
+		}),
+		rebootRequired: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "reboot_required",
+			Help:      "Host requires a reboot to finish applying upgrades",
+		}),
+		lockHeld: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "lock_held",
+			Help:      "Host is holding the kube lock",
+		}),
+		nextRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "next_run_timestamp_seconds",
+			Help:      "Time of the next scheduled run",
+		}),
+		lockHolder: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "lock_holder",
+			Help:      "Node currently holding the kube lock, 1 for each holder",
+		}, []string{"holder"}),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.phaseTimestamp,
+		metrics.phaseSuccess,
+		metrics.phaseDuration,
+		metrics.upgradePackages,
+		metrics.rebootRequired,
+		metrics.lockHeld,
+		metrics.nextRun,
+		metrics.lockHolder,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "reboot_required_age_seconds",
+			Help:      "Time since the host started requiring a reboot, 0 if not required",
+		}, metrics.rebootRequiredAge),
+	)
+
+	metrics.mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+
+	health.register(metrics.mux)
+
+	if options.MetricsListen == "" {
+		log.Printf("No --metrics-listen given, not serving metrics or health checks")
+	} else if err := metrics.listen(options.MetricsListen); err != nil {
+		return nil, fmt.Errorf("Invalid --metrics-listen=%v: %v", options.MetricsListen, err)
+	} else {
+		log.Printf("Using --metrics-listen=%v, serving metrics at /metrics, health checks at /healthz and /readyz", options.MetricsListen)
+	}
+
+	return &metrics, nil
+}
+
+// fails early if unable to listen, serves in the background
+func (metrics *Metrics) listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := http.Serve(listener, metrics.mux); err != nil {
+			log.Fatalf("Failed to serve metrics on %v: %v", addr, err)
+		}
+	}()
+
+	return nil
+}
+
+func (metrics *Metrics) rebootRequiredAge() float64 {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if metrics.rebootRequiredSince.IsZero() {
+		return 0
+	} else {
+		return time.Since(metrics.rebootRequiredSince).Seconds()
+	}
+}
+
+// record the result of a run phase started at the given time
+func (metrics *Metrics) RunPhase(phase string, startTime time.Time, err error) {
+	var endTime = time.Now()
+
+	metrics.phaseTimestamp.WithLabelValues(phase).Set(float64(endTime.Unix()))
+	metrics.phaseDuration.WithLabelValues(phase).Set(endTime.Sub(startTime).Seconds())
+
+	if err != nil {
+		metrics.phaseSuccess.WithLabelValues(phase).Set(0)
+	} else {
+		metrics.phaseSuccess.WithLabelValues(phase).Set(1)
+	}
+}
+
+// record the host status after a successful upgrade
+func (metrics *Metrics) UpdateHostStatus(status hosts.Status) {
+	metrics.upgradePackages.Set(float64(status.UpgradePackages))
+
+	metrics.UpdateRebootStatus(status)
+}
+
+// record the host reboot status, without any upgrade
+func (metrics *Metrics) UpdateRebootStatus(status hosts.Status) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if status.RebootRequired {
+		metrics.rebootRequired.Set(1)
+		metrics.rebootRequiredSince = status.RebootRequiredSince
+	} else {
+		metrics.rebootRequired.Set(0)
+		metrics.rebootRequiredSince = time.Time{}
+	}
+}
+
+func (metrics *Metrics) SetLockHeld(held bool) {
+	if held {
+		metrics.lockHeld.Set(1)
+	} else {
+		metrics.lockHeld.Set(0)
+	}
+}
+
+// replace the current kube lock holders
+func (metrics *Metrics) SetLockHolders(holders []string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.lockHolder.Reset()
+
+	for _, holder := range holders {
+		metrics.lockHolder.WithLabelValues(holder).Set(1)
+	}
+}
+
+func (metrics *Metrics) SetNextRun(nextTime time.Time) {
+	metrics.nextRun.Set(float64(nextTime.Unix()))
+}
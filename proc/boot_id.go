@@ -0,0 +1,17 @@
+package proc
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+const BootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// Returns the random UUID generated by the kernel on each boot
+func ReadBootID() (string, error) {
+	if data, err := ioutil.ReadFile(BootIDPath); err != nil {
+		return "", err
+	} else {
+		return strings.TrimSpace(string(data)), nil
+	}
+}
@@ -0,0 +1,18 @@
+package proc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReadBootID(t *testing.T) {
+	bootID, err := ReadBootID()
+
+	assert.NoErrorf(t, err, "ReadBootID")
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, bootID)
+
+	again, err := ReadBootID()
+
+	assert.NoErrorf(t, err, "ReadBootID")
+	assert.Equal(t, bootID, again, "same boot")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kontena/pharos-host-upgrades/hosts"
+)
+
+const RebootStateFile = "reboot-state.json"
+
+// steps of the drain => mark => reboot => verify sequence
+type RebootPhase string
+
+const (
+	RebootPhaseNone      RebootPhase = ""
+	RebootPhaseDraining  RebootPhase = "draining"
+	RebootPhaseRebooting RebootPhase = "rebooting"
+)
+
+// persisted in the --host-mount, which is reset when the host reboots
+//
+// Mirrors the phase in the kube node reboot annotation.
+type RebootState struct {
+	config hosts.Config
+
+	Phase  RebootPhase `json:"phase"`
+	Time   time.Time   `json:"time"`
+	BootID string      `json:"bootID,omitempty"`
+}
+
+func loadRebootState(config hosts.Config) (*RebootState, error) {
+	var state = RebootState{config: config}
+	var buf bytes.Buffer
+
+	if _, exists, err := config.StatHostFile(RebootStateFile); err != nil {
+		return nil, fmt.Errorf("Failed to stat host %v: %v", RebootStateFile, err)
+	} else if !exists {
+		return &state, nil
+	} else if err := config.ReadHostFile(RebootStateFile, &buf); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(buf.Bytes(), &state); err != nil {
+		log.Printf("Ignoring invalid host %v: %v", RebootStateFile, err)
+
+		return &RebootState{config: config}, nil
+	} else {
+		log.Printf("Loaded host %v: phase=%v since %v (boot_id=%v)", RebootStateFile, state.Phase, state.Time, state.BootID)
+
+		return &state, nil
+	}
+}
+
+func (state *RebootState) save() error {
+	if data, err := json.Marshal(state); err != nil {
+		return err
+	} else if _, err := state.config.WriteHostFile(RebootStateFile, bytes.NewReader(data)); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// transition to the given phase, logging any errors
+func (state *RebootState) Set(phase RebootPhase, bootID string) {
+	state.Phase = phase
+	state.Time = time.Now()
+	state.BootID = bootID
+
+	if err := state.save(); err != nil {
+		log.Printf("Failed to save reboot state: %v", err)
+	}
+}
+
+// reset after recovering or aborting the reboot, logging any errors
+func (state *RebootState) Clear() {
+	if state.Phase == RebootPhaseNone {
+		return
+	}
+
+	state.Phase = RebootPhaseNone
+	state.Time = time.Time{}
+	state.BootID = ""
+
+	if err := state.save(); err != nil {
+		log.Printf("Failed to clear reboot state: %v", err)
+	}
+}
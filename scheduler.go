@@ -3,101 +3,636 @@ package main
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron"
+
+	"github.com/kontena/pharos-host-upgrades/systemd"
 )
 
+const DefaultScheduleAttempts = 3
+const DefaultScheduleBackoff = 1 * time.Minute
+const MaxScheduleBackoff = 1 * time.Hour
+
+// run errors that are not retried, such as misconfiguration
+type PermanentError struct {
+	Err error
+}
+
+func (err PermanentError) Error() string {
+	return err.Err.Error()
+}
+
+// use the host time zone from systemd-timedated
+const ScheduleTimezoneHost = "host"
+
+// evaluates the schedule using the wall clock time in the location
+//
+// The wrapped schedule only sees UTC times, avoiding DST transitions: times skipped by the clock
+// moving forward run at the corresponding time after the transition, and times repeated by the
+// clock moving back only run once.
+type locationSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func wallClock(t time.Time, location *time.Location) time.Time {
+	t = t.In(location)
+
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// wall clock times skipped by a DST transition are shifted forwards by the transition, and wall clock times
+// repeated by a DST transition use the first occurrence
+func fromWallClock(wall time.Time, location *time.Location) time.Time {
+	var t = time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), location)
+
+	// the zone offsets in effect before and after any transition on the same day
+	_, before := t.Add(-12 * time.Hour).Zone()
+	_, after := t.Add(12 * time.Hour).Zone()
+
+	var early = wall.Add(-time.Duration(before) * time.Second).In(location)
+	var late = wall.Add(-time.Duration(after) * time.Second).In(location)
+
+	if wallClock(early, location).Equal(wall) {
+		return early // before the transition, or the first of any repeated times
+	} else if wallClock(late, location).Equal(wall) {
+		return late // after the transition
+	} else {
+		return early // skipped by the transition, using the offset from before the transition shifts it forwards
+	}
+}
+
+func (s locationSchedule) Next(t time.Time) time.Time {
+	var wall = wallClock(t, s.location)
+
+	for {
+		wall = s.schedule.Next(wall)
+
+		if wall.IsZero() {
+			return wall
+		} else if next := fromWallClock(wall, s.location); next.After(t) {
+			return next
+		}
+	}
+}
+
+func loadScheduleLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	} else if timezone != ScheduleTimezoneHost {
+		return time.LoadLocation(timezone)
+	} else if hostTimezone, err := systemd.GetTimezone(); err != nil {
+		return nil, fmt.Errorf("Failed to get host time zone: %v", err)
+	} else {
+		return time.LoadLocation(hostTimezone)
+	}
+}
+
+// delays the schedule by a fixed offset
+type splaySchedule struct {
+	schedule cron.Schedule
+	offset   time.Duration
+}
+
+func (s splaySchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.Add(-s.offset)).Add(s.offset)
+}
+
+// stable offset within the splay, hashed from the node name
+func splayOffset(name string, splay time.Duration) time.Duration {
+	var hash = fnv.New64a()
+	var seconds = uint64(splay / time.Second)
+
+	hash.Write([]byte(name))
+
+	if seconds == 0 {
+		return 0
+	} else {
+		return time.Duration(hash.Sum64()%seconds) * time.Second
+	}
+}
+
+// a scheduled or triggered run, with an optional callback once completed
+type scheduledRun struct {
+	startTime time.Time
+	done      func(err error)
+}
+
 type Scheduler struct {
+	ch       chan scheduledRun
+	blackout Blackout
+	state    *State
+	metrics  *Metrics
+	health   *Health
+	offset   time.Duration // --schedule-splay
+	location *time.Location
+	attempts int
+	backoff  time.Duration
+
+	// retry backoff cap, and time.After unless testing
+	maxBackoff time.Duration
+	after      func(time.Duration) <-chan time.Time
+
+	// --reboot-schedule, nil if rebooting after any upgrade
+	reboot       cron.Schedule
+	rebootWindow time.Duration
+	rebootCh     chan time.Time
+	rebootFunc   func(ctx context.Context, force bool) error
+	rebootTimer  *time.Timer // pending reboot
+	rebootTime   time.Time
+	rebootForce  bool
+
+	// called for each failed run attempt, with a zero retryTime if not retried
+	onFailure func(attempt int, attempts int, err error, retryTime time.Time) error
+
+	mutex    sync.Mutex
 	option   string
 	schedule cron.Schedule
 	window   time.Duration
-	ch       chan time.Time
+	cron     *cron.Cron // nil until running
 }
 
-func makeScheduler(options Options) (Scheduler, error) {
+func makeScheduler(options Options, blackout Blackout, state *State, metrics *Metrics, health *Health) (*Scheduler, error) {
 	var scheduler = Scheduler{
-		option: options.Schedule,
-		window: options.ScheduleWindow,
-		ch:     make(chan time.Time),
+		option:   options.Schedule,
+		window:   options.ScheduleWindow,
+		ch:       make(chan scheduledRun),
+		rebootCh: make(chan time.Time),
+		blackout: blackout,
+		state:    state,
+		metrics:  metrics,
+		health:   health,
+		attempts: options.ScheduleAttempts,
+		backoff:  options.ScheduleBackoff,
+
+		maxBackoff: MaxScheduleBackoff,
+		after:      time.After,
+	}
+
+	if options.ScheduleAttempts < 1 {
+		return nil, fmt.Errorf("Invalid --schedule-attempts=%v: must be at least 1", options.ScheduleAttempts)
+	}
+
+	if location, err := loadScheduleLocation(options.ScheduleTimezone); err != nil {
+		return nil, fmt.Errorf("Invalid --schedule-timezone=%v: %v", options.ScheduleTimezone, err)
+	} else {
+		log.Printf("Using --schedule-timezone=%v", location)
+
+		scheduler.location = location
 	}
 
-	if options.Schedule == "" {
-		log.Printf("No --schedule given, will run once")
+	if options.ScheduleSplay != 0 {
+		if options.ScheduleWindow != 0 && options.ScheduleSplay > options.ScheduleWindow {
+			return nil, fmt.Errorf("Invalid --schedule-splay=%v: must be within the --schedule-window=%v", options.ScheduleSplay, options.ScheduleWindow)
+		} else if name, err := splayName(options); err != nil {
+			return nil, fmt.Errorf("Invalid --schedule-splay=%v: %v", options.ScheduleSplay, err)
+		} else {
+			scheduler.offset = splayOffset(name, options.ScheduleSplay)
+		}
+	}
 
-		return scheduler, nil
-	} else if schedule, err := cron.ParseStandard(options.Schedule); err != nil {
-		return scheduler, fmt.Errorf("Invalid --schedule=%v: %v", options.Schedule, err)
+	if schedule, err := scheduler.parse(options.Schedule, options.ScheduleWindow, scheduler.offset); err != nil {
+		return nil, fmt.Errorf("Invalid --schedule=%v: %v", options.Schedule, err)
 	} else {
 		scheduler.schedule = schedule
 	}
 
-	return scheduler, nil
+	if options.RebootSchedule != "" {
+		if !options.Reboot && options.MaxUptime == 0 {
+			return nil, fmt.Errorf("Invalid --reboot-schedule=%v: requires --reboot or --max-uptime", options.RebootSchedule)
+		} else if options.RebootWindow <= 0 {
+			return nil, fmt.Errorf("Invalid --reboot-window=%v: must be positive", options.RebootWindow)
+		} else if schedule, err := scheduler.parse(options.RebootSchedule, options.RebootWindow, 0); err != nil { // not splayed, reboots are serialized by the kube lock
+			return nil, fmt.Errorf("Invalid --reboot-schedule=%v: %v", options.RebootSchedule, err)
+		} else {
+			log.Printf("Using --reboot-schedule=%#v with --reboot-window=%v", options.RebootSchedule, options.RebootWindow)
+
+			scheduler.reboot = schedule
+			scheduler.rebootWindow = options.RebootWindow
+		}
+	}
+
+	return &scheduler, nil
 }
 
-func (scheduler *Scheduler) run(f func(ctx context.Context) error) {
-	initTime := time.Now()
-	nextTime := scheduler.schedule.Next(initTime)
+// the splay is hashed from the kube node name, or the hostname if not using kube
+func splayName(options Options) (string, error) {
+	if options.Kube.Node != "" {
+		return options.Kube.Node, nil
+	} else {
+		return os.Hostname()
+	}
+}
+
+// returns a nil schedule if not set, delayed by any splay offset
+func (scheduler *Scheduler) parse(option string, window time.Duration, offset time.Duration) (cron.Schedule, error) {
+	if option == "" {
+		return nil, nil
+	} else if schedule, err := cron.ParseStandard(option); err != nil {
+		return nil, err
+	} else if offset == 0 {
+		return locationSchedule{schedule, scheduler.location}, nil
+	} else if window != 0 && offset >= window {
+		return nil, fmt.Errorf("splay offset %v exceeds window %v", offset, window)
+	} else {
+		return splaySchedule{locationSchedule{schedule, scheduler.location}, offset}, nil
+	}
+}
+
+// start a new cron for the current schedule, stopping any old cron
+//
+// Must be called with the mutex held.
+func (scheduler *Scheduler) start() {
+	if scheduler.cron != nil {
+		scheduler.cron.Stop()
+	}
+
+	scheduler.cron = cron.NewWithLocation(scheduler.location)
+
+	if scheduler.schedule == nil {
+		log.Printf("No schedule, waiting for a new schedule or trigger")
+
+		scheduler.health.SetNextRun(time.Time{})
+
+		return
+	}
+
+	var initTime = time.Now().In(scheduler.location)
+	var nextTime = scheduler.schedule.Next(initTime)
+
+	if scheduler.offset != 0 {
+		log.Printf("Using schedule=%#v with splay offset %v, next upgrade at: %v (in %v)", scheduler.option, scheduler.offset, nextTime, nextTime.Sub(initTime))
+	} else {
+		log.Printf("Using schedule=%#v, next upgrade at: %v (in %v)", scheduler.option, nextTime, nextTime.Sub(initTime))
+	}
 
-	log.Printf("Using --schedule=%#v, first upgrade at: %v (in %v)", scheduler.option, nextTime, nextTime.Sub(initTime))
+	scheduler.metrics.SetNextRun(nextTime)
+	scheduler.health.SetNextRun(nextTime)
 
 	if scheduler.window != 0 {
-		log.Printf("Using --schedule-window=%v", scheduler.window)
+		log.Printf("Using schedule window=%v", scheduler.window)
 	}
 
-	for startTime := range scheduler.ch {
-		func() {
-			ctx := context.Background()
+	var schedule = scheduler.schedule
 
-			if scheduler.window != 0 {
-				deadline := startTime.Add(scheduler.window)
-				deadlineCtx, cancelCtx := context.WithDeadline(ctx, deadline)
+	scheduler.cron.Schedule(schedule, cron.FuncJob(func() {
+		var now = time.Now()
 
-				log.Printf("Schedule run started, deadline at %v", deadline)
+		// heartbeat for the /healthz check, even if the run is skipped
+		scheduler.health.SetNextRun(schedule.Next(now))
 
-				ctx = deadlineCtx
-				defer cancelCtx()
-			} else {
-				log.Printf("Schedule run started, no deadline")
+		// the window starts from the scheduled time, before the splay
+		scheduler.trigger(scheduledRun{startTime: now.Add(-scheduler.offset)})
+	}))
+	scheduler.cron.Start()
+}
 
-			}
+// Update the schedule and window, taking effect for the next scheduled run
+//
+// An empty schedule stops any further scheduled runs.
+func (scheduler *Scheduler) Update(option string, window time.Duration) error {
+	schedule, err := scheduler.parse(option, window, scheduler.offset)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule=%v: %v", option, err)
+	}
 
-			if err := f(ctx); err != nil {
-				// TODO: break out of scheduler loop instead?
-				log.Fatalf("%v", err)
-			}
-		}()
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if option == scheduler.option && window == scheduler.window {
+		return nil
+	}
+
+	log.Printf("Update schedule=%#v with window=%v", option, window)
+
+	scheduler.option = option
+	scheduler.schedule = schedule
+	scheduler.window = window
+
+	if scheduler.cron != nil {
+		scheduler.start()
+	}
+
+	return nil
+}
+
+// the current schedule window, or zero if no deadline
+func (scheduler *Scheduler) getWindow() time.Duration {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.window
+}
+
+func (scheduler *Scheduler) logNextRun(startTime time.Time) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	var endTime = time.Now().In(scheduler.location)
 
-		endTime := time.Now()
+	if scheduler.schedule == nil {
+		log.Printf("Schedule run completed in %v, no schedule", endTime.Sub(startTime))
+	} else {
 		nextTime := scheduler.schedule.Next(endTime)
 
 		log.Printf("Schedule run completed in %v, next upgrade at: %v (in %v)", endTime.Sub(startTime), nextTime, nextTime.Sub(endTime))
+
+		scheduler.metrics.SetNextRun(nextTime)
 	}
 }
 
-func (scheduler *Scheduler) trigger() {
-	select {
-	case scheduler.ch <- time.Now():
+// run with a deadline at the window from the start time, returning any error from the last attempt
+func (scheduler *Scheduler) runWindow(startTime time.Time, window time.Duration, f func(ctx context.Context) error) error {
+	ctx := context.Background()
+
+	if window != 0 {
+		deadline := startTime.Add(window)
+		deadlineCtx, cancelCtx := context.WithDeadline(ctx, deadline)
+
+		log.Printf("Schedule run started, deadline at %v", deadline)
+
+		ctx = deadlineCtx
+		defer cancelCtx()
+	} else {
+		log.Printf("Schedule run started, no deadline")
+
+	}
+
+	return scheduler.runRetry(ctx, f)
+}
+
+func (scheduler *Scheduler) run(f func(ctx context.Context) error) {
+	for {
+		select {
+		case run := <-scheduler.ch:
+			var err error
+
+			if scheduler.skipBlackout(run.startTime) {
+				err = fmt.Errorf("Skipped during blackout period")
+			} else if err = scheduler.runWindow(run.startTime, scheduler.getWindow(), f); err != nil {
+				log.Printf("Schedule run failed: %v", err)
+			}
+
+			if run.done != nil {
+				run.done(err)
+			}
+
+			scheduler.logNextRun(run.startTime)
+
+		case startTime := <-scheduler.rebootCh:
+			var force = scheduler.clearReboot()
+
+			var reboot = func(ctx context.Context) error {
+				return scheduler.rebootFunc(ctx, force)
+			}
+
+			if scheduler.skipBlackout(startTime) {
+				log.Printf("Scheduled reboot skipped, rescheduled at: %v", scheduler.ScheduleReboot(force))
+			} else if err := scheduler.runWindow(startTime, scheduler.rebootWindow, reboot); err != nil {
+				log.Printf("Scheduled reboot failed, rescheduled at %v: %v", scheduler.ScheduleReboot(force), err)
+			}
+		}
+	}
+}
+
+// set the run function for scheduled reboots, with force set if any of the postponed reboots was forced
+func (scheduler *Scheduler) OnReboot(f func(ctx context.Context, force bool) error) {
+	scheduler.rebootFunc = f
+}
+
+// reboots are allowed within the --reboot-window from each --reboot-schedule time, or always without a --reboot-schedule
+func (scheduler *Scheduler) RebootAllowed(t time.Time) bool {
+	if scheduler.reboot == nil {
+		return true
+	} else {
+		return !scheduler.reboot.Next(t.Add(-scheduler.rebootWindow)).After(t)
+	}
+}
+
+// schedule a reboot run at the next --reboot-schedule time, unless already pending
+//
+// A forced reboot keeps the pending reboot forced until it is run.
+//
+// Returns the time of the pending reboot run.
+func (scheduler *Scheduler) ScheduleReboot(force bool) time.Time {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.rebootForce = scheduler.rebootForce || force
+
+	if scheduler.rebootTimer != nil {
+		return scheduler.rebootTime
+	}
+
+	var now = time.Now().In(scheduler.location)
+	var rebootTime = scheduler.reboot.Next(now)
+
+	scheduler.rebootTime = rebootTime
+	scheduler.rebootTimer = time.AfterFunc(rebootTime.Sub(now), func() {
+		// waits for any upgrade run to complete, the reboot remains pending until received
+		scheduler.rebootCh <- rebootTime
+	})
+
+	return rebootTime
+}
+
+// clear the pending reboot once received for running, returning true if forced
+func (scheduler *Scheduler) clearReboot() bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	var force = scheduler.rebootForce
+
+	scheduler.rebootTimer = nil
+	scheduler.rebootForce = false
+
+	return force
+}
+
+// returns true if the run should be skipped during a blackout period
+func (scheduler *Scheduler) skipBlackout(startTime time.Time) bool {
+	if period, active := scheduler.blackout.Check(startTime); !active {
+		return false
+	} else {
+		log.Printf("Skipping run during blackout period %v, next allowed at %v", period, scheduler.blackout.NextAllowed(startTime))
+
+		return true
+	}
+}
+
+// set a handler for failed run attempts, used to update the status
+func (scheduler *Scheduler) OnFailure(onFailure func(attempt int, attempts int, err error, retryTime time.Time) error) {
+	scheduler.onFailure = onFailure
+}
+
+func (scheduler *Scheduler) reportFailure(attempt int, err error, retryTime time.Time) {
+	if scheduler.onFailure == nil {
 		return
+	}
+
+	if reportErr := scheduler.onFailure(attempt, scheduler.attempts, err, retryTime); reportErr != nil {
+		log.Printf("Failed to report run failure: %v", reportErr)
+	}
+}
+
+// retry transient failures with exponential backoff, up to the maximum attempts and within the context deadline
+//
+// The doubled backoff is capped at the maxBackoff, unless the initial backoff is already longer.
+func (scheduler *Scheduler) runRetry(ctx context.Context, f func(ctx context.Context) error) error {
+	var backoff = scheduler.backoff
+
+	for attempt := 1; ; attempt++ {
+		var err = scheduler.runOnce(ctx, f)
+		var retryTime = time.Now().Add(backoff)
+
+		if err == nil {
+			return nil
+		} else if _, permanent := err.(PermanentError); permanent {
+			log.Printf("Run attempt %d/%d failed permanently, not retrying: %v", attempt, scheduler.attempts, err)
+		} else if attempt >= scheduler.attempts {
+			log.Printf("Run attempt %d/%d failed, no attempts left: %v", attempt, scheduler.attempts, err)
+		} else if deadline, ok := ctx.Deadline(); ok && retryTime.After(deadline) {
+			log.Printf("Run attempt %d/%d failed, no time left before deadline at %v: %v", attempt, scheduler.attempts, deadline, err)
+		} else {
+			log.Printf("Run attempt %d/%d failed, retrying in %v: %v", attempt, scheduler.attempts, backoff, err)
+
+			scheduler.reportFailure(attempt, err, retryTime)
+
+			select {
+			case <-ctx.Done():
+				return err
+			case <-scheduler.after(backoff):
+			}
+
+			if backoff*2 <= scheduler.maxBackoff {
+				backoff *= 2
+			} else if backoff < scheduler.maxBackoff {
+				backoff = scheduler.maxBackoff
+			}
+
+			continue
+		}
+
+		scheduler.reportFailure(attempt, err, time.Time{})
+
+		return err
+	}
+}
+
+func (scheduler *Scheduler) runOnce(ctx context.Context, f func(ctx context.Context) error) error {
+	var startTime = time.Now()
+
+	scheduler.health.StartRun(ctx, startTime)
+	defer scheduler.health.EndRun()
+
+	var err = f(ctx)
+
+	scheduler.metrics.RunPhase(MetricsPhaseRun, startTime, err)
+
+	return err
+}
+
+// returns false if the scheduler is busy
+func (scheduler *Scheduler) trigger(run scheduledRun) bool {
+	select {
+	case scheduler.ch <- run:
+		return true
 	default:
 		log.Printf("Scheduler is busy, skipping scheduled run")
+		return false
 	}
 }
 
-func (scheduler Scheduler) Run(f func(ctx context.Context) error) error {
-	if scheduler.schedule == nil {
-		return f(context.Background())
+// run immediately if a scheduled run was missed since the last successful run, and its window has not yet ended
+func (scheduler *Scheduler) catchUp() {
+	var lastRun = scheduler.state.GetLastRun()
+	var now = time.Now().In(scheduler.location)
+
+	scheduler.mutex.Lock()
+	var schedule = scheduler.schedule
+	var window = scheduler.window
+	scheduler.mutex.Unlock()
+
+	if schedule == nil {
+		return
+	} else if lastRun.IsZero() {
+		log.Printf("No last run, skipping catch-up")
+		return
+	}
+
+	var missedTime = schedule.Next(lastRun)
+
+	if missedTime.After(now) {
+		log.Printf("No missed runs since last run at %v", lastRun)
+		return
+	}
+
+	// only the most recently missed run
+	for nextTime := schedule.Next(missedTime); !nextTime.After(now); nextTime = schedule.Next(nextTime) {
+		missedTime = nextTime
+	}
+
+	// the window starts from the scheduled time, before the splay
+	var startTime = missedTime.Add(-scheduler.offset)
+
+	if window != 0 && !now.Before(startTime.Add(window)) {
+		log.Printf("Missed scheduled run at %v since last run at %v, but the window=%v has ended, waiting for the next scheduled run", missedTime, lastRun, window)
 	} else {
-		defer close(scheduler.ch)
-		go scheduler.run(f)
+		log.Printf("Missed scheduled run at %v since last run at %v, running now", missedTime, lastRun)
+
+		go func() {
+			scheduler.ch <- scheduledRun{startTime: startTime}
+		}()
 	}
+}
 
-	c := cron.New()
-	c.Schedule(scheduler.schedule, cron.FuncJob(func() {
-		scheduler.trigger()
-	}))
-	c.Run()
+// scheduled runs, or run once if no schedule
+func (scheduler *Scheduler) Scheduled() bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.schedule != nil
+}
+
+// triggers are only supported for scheduled runs, calling done once the accepted run has completed
+func (scheduler *Scheduler) Trigger(done func(err error)) bool {
+	scheduler.mutex.Lock()
+	var running = scheduler.cron != nil
+	scheduler.mutex.Unlock()
+
+	if !running {
+		return false
+	} else {
+		return scheduler.trigger(scheduledRun{startTime: time.Now(), done: done})
+	}
+}
+
+func (scheduler *Scheduler) Run(f func(ctx context.Context) error) error {
+	if !scheduler.Scheduled() && scheduler.reboot != nil {
+		return fmt.Errorf("Using --reboot-schedule requires a --schedule")
+	} else if !scheduler.Scheduled() {
+		log.Printf("No schedule given, will run once")
+
+		if scheduler.skipBlackout(time.Now()) {
+			return nil
+		}
+
+		return scheduler.runRetry(context.Background(), f)
+	}
+
+	scheduler.mutex.Lock()
+	scheduler.start()
+	scheduler.mutex.Unlock()
+
+	scheduler.catchUp()
+
+	// runs forever
+	scheduler.run(f)
 
 	return nil
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation %v: %v", name, err)
+	}
+
+	return location
+}
+
+func parseTestTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("Parse %v: %v", value, err)
+	}
+
+	return parsed
+}
+
+// Europe/Helsinki moves from EET (+02:00) to EEST (+03:00) at 2018-03-25 03:00, and back at 2018-10-28 04:00
+func TestFromWallClockDST(t *testing.T) {
+	var location = loadTestLocation(t, "Europe/Helsinki")
+
+	for _, test := range []struct {
+		wall     string
+		expected string
+	}{
+		{"2018-03-24T03:30:00Z", "2018-03-24T03:30:00+02:00"},
+		{"2018-03-25T02:59:00Z", "2018-03-25T02:59:00+02:00"},
+		{"2018-03-25T03:00:00Z", "2018-03-25T04:00:00+03:00"}, // skipped
+		{"2018-03-25T03:30:00Z", "2018-03-25T04:30:00+03:00"}, // skipped
+		{"2018-03-25T04:00:00Z", "2018-03-25T04:00:00+03:00"},
+		{"2018-03-25T04:30:00Z", "2018-03-25T04:30:00+03:00"},
+		{"2018-10-28T02:30:00Z", "2018-10-28T02:30:00+03:00"},
+		{"2018-10-28T03:00:00Z", "2018-10-28T03:00:00+03:00"}, // repeated
+		{"2018-10-28T03:30:00Z", "2018-10-28T03:30:00+03:00"}, // repeated
+		{"2018-10-28T04:00:00Z", "2018-10-28T04:00:00+02:00"},
+		{"2018-10-28T04:30:00Z", "2018-10-28T04:30:00+02:00"},
+	} {
+		var wall = parseTestTime(t, test.wall)
+		var actual = fromWallClock(wall, location)
+
+		assert.Equal(t, test.expected, actual.Format(time.RFC3339), "fromWallClock(%v)", test.wall)
+	}
+}
+
+func TestLocationScheduleDST(t *testing.T) {
+	var location = loadTestLocation(t, "Europe/Helsinki")
+
+	for _, test := range []struct {
+		schedule string
+		from     string
+		expected string
+	}{
+		// spring forward: skipped times run once after the transition
+		{"30 3 * * *", "2018-03-25T00:00:00+02:00", "2018-03-25T04:30:00+03:00"},
+		{"30 3 * * *", "2018-03-25T04:30:00+03:00", "2018-03-26T03:30:00+03:00"},
+		{"0 * * * *", "2018-03-25T02:30:00+02:00", "2018-03-25T04:00:00+03:00"},
+		{"0 * * * *", "2018-03-25T04:00:00+03:00", "2018-03-25T05:00:00+03:00"},
+		{"30 4 * * *", "2018-03-25T00:00:00+02:00", "2018-03-25T04:30:00+03:00"},
+
+		// fall back: repeated times only run once
+		{"30 3 * * *", "2018-10-28T00:00:00+03:00", "2018-10-28T03:30:00+03:00"},
+		{"30 3 * * *", "2018-10-28T03:30:00+03:00", "2018-10-29T03:30:00+02:00"},
+		{"30 3 * * *", "2018-10-28T03:10:00+02:00", "2018-10-29T03:30:00+02:00"},
+		{"0 * * * *", "2018-10-28T03:00:00+03:00", "2018-10-28T04:00:00+02:00"},
+		{"0 * * * *", "2018-10-28T03:30:00+02:00", "2018-10-28T04:00:00+02:00"},
+	} {
+		schedule, err := cron.ParseStandard(test.schedule)
+		if err != nil {
+			t.Fatalf("ParseStandard %v: %v", test.schedule, err)
+		}
+
+		var from = parseTestTime(t, test.from)
+		var actual = locationSchedule{schedule, location}.Next(from)
+
+		assert.Equal(t, test.expected, actual.Format(time.RFC3339), "%#v Next(%v)", test.schedule, test.from)
+	}
+}
+
+func TestSplayOffset(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		splay    time.Duration
+		expected time.Duration
+	}{
+		{"worker-1", 1 * time.Hour, 45 * time.Second},
+		{"worker-2", 1 * time.Hour, 50*time.Minute + 12*time.Second},
+		{"worker-2", 30 * time.Minute, 20*time.Minute + 12*time.Second},
+		{"master-1", 1 * time.Hour, 7*time.Minute + 13*time.Second},
+		{"worker-1", 0, 0},
+		{"worker-1", 500 * time.Millisecond, 0},
+	} {
+		assert.Equal(t, test.expected, splayOffset(test.name, test.splay), "splayOffset(%v, %v)", test.name, test.splay)
+	}
+}
+
+func TestSplayOffsetBound(t *testing.T) {
+	for _, splay := range []time.Duration{1 * time.Second, 1 * time.Minute, 1 * time.Hour} {
+		for i := 0; i < 100; i++ {
+			var name = fmt.Sprintf("node-%d", i)
+			var offset = splayOffset(name, splay)
+
+			assert.True(t, offset >= 0 && offset < splay, "splayOffset(%v, %v) = %v is within the splay", name, splay, offset)
+			assert.Equal(t, offset, splayOffset(name, splay), "splayOffset(%v, %v) is stable", name, splay)
+		}
+	}
+}
+
+func TestSplaySchedule(t *testing.T) {
+	schedule, err := cron.ParseStandard("0 3 * * *")
+	if err != nil {
+		t.Fatalf("ParseStandard: %v", err)
+	}
+
+	var splay = splaySchedule{locationSchedule{schedule, time.UTC}, 10 * time.Minute}
+
+	for _, test := range []struct {
+		from     string
+		expected string
+	}{
+		{"2018-10-01T02:00:00Z", "2018-10-01T03:10:00Z"},
+		{"2018-10-01T03:00:00Z", "2018-10-01T03:10:00Z"},
+		{"2018-10-01T03:05:00Z", "2018-10-01T03:10:00Z"},
+		{"2018-10-01T03:10:00Z", "2018-10-02T03:10:00Z"},
+		{"2018-10-01T04:00:00Z", "2018-10-02T03:10:00Z"},
+	} {
+		var actual = splay.Next(parseTestTime(t, test.from))
+
+		assert.Equal(t, test.expected, actual.Format(time.RFC3339), "Next(%v)", test.from)
+	}
+}
+
+func TestSchedulerParseSplay(t *testing.T) {
+	var scheduler = Scheduler{location: time.UTC}
+
+	for _, test := range []struct {
+		window time.Duration
+		offset time.Duration
+		err    string
+	}{
+		{0, 0, ""},
+		{0, 2 * time.Hour, ""},
+		{1 * time.Hour, 0, ""},
+		{1 * time.Hour, 59 * time.Minute, ""},
+		{1 * time.Hour, 1 * time.Hour, "splay offset 1h0m0s exceeds window 1h0m0s"},
+		{1 * time.Hour, 2 * time.Hour, "splay offset 2h0m0s exceeds window 1h0m0s"},
+	} {
+		schedule, err := scheduler.parse("0 3 * * *", test.window, test.offset)
+
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, "parse window=%v offset=%v", test.window, test.offset)
+		} else if assert.NoError(t, err, "parse window=%v offset=%v", test.window, test.offset) {
+			assert.NotNil(t, schedule)
+		}
+	}
+}
+
+func TestMakeSchedulerSplay(t *testing.T) {
+	var options = Options{
+		Schedule:         "0 3 * * *",
+		ScheduleWindow:   1 * time.Hour,
+		ScheduleSplay:    2 * time.Hour,
+		ScheduleTimezone: "UTC",
+		ScheduleAttempts: 1,
+	}
+	options.Kube.Node = "worker-1"
+
+	_, err := makeScheduler(options, nil, nil, nil, nil)
+	assert.EqualError(t, err, "Invalid --schedule-splay=2h0m0s: must be within the --schedule-window=1h0m0s")
+
+	options.ScheduleSplay = 1 * time.Hour
+
+	if scheduler, err := makeScheduler(options, nil, nil, nil, nil); assert.NoError(t, err) {
+		assert.Equal(t, 45*time.Second, scheduler.offset)
+	}
+}
+
+// records the retry waits and failures, without waiting
+type testRetry struct {
+	waits    []time.Duration
+	attempts []int
+	retries  []bool
+}
+
+func makeTestRetryScheduler(t *testing.T, attempts int, backoff time.Duration, maxBackoff time.Duration) (*Scheduler, *testRetry) {
+	var options = Options{ScheduleAttempts: attempts, ScheduleBackoff: backoff}
+	var health = makeHealth(options)
+	var retry testRetry
+
+	metrics, err := makeMetrics(options, health)
+	if err != nil {
+		t.Fatalf("makeMetrics: %v", err)
+	}
+
+	var scheduler = Scheduler{
+		metrics:    metrics,
+		health:     health,
+		attempts:   attempts,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		after: func(d time.Duration) <-chan time.Time {
+			var ch = make(chan time.Time, 1)
+
+			retry.waits = append(retry.waits, d)
+			ch <- time.Now()
+
+			return ch
+		},
+		onFailure: func(attempt int, attempts int, err error, retryTime time.Time) error {
+			retry.attempts = append(retry.attempts, attempt)
+			retry.retries = append(retry.retries, !retryTime.IsZero())
+
+			return nil
+		},
+	}
+
+	return &scheduler, &retry
+}
+
+// fails with the errors in order, and then succeeds
+func makeTestRetryFunc(errs ...error) (func(ctx context.Context) error, *int) {
+	var calls int
+
+	return func(ctx context.Context) error {
+		calls++
+
+		if calls <= len(errs) {
+			return errs[calls-1]
+		} else {
+			return nil
+		}
+	}, &calls
+}
+
+func TestRunRetry(t *testing.T) {
+	var transientErr = fmt.Errorf("transient")
+	var permanentErr = PermanentError{fmt.Errorf("permanent")}
+
+	for _, test := range []struct {
+		name       string
+		attempts   int
+		backoff    time.Duration
+		maxBackoff time.Duration
+		window     time.Duration // zero for no deadline
+		errs       []error
+
+		err      error
+		calls    int
+		waits    []time.Duration
+		failures []int
+		retries  []bool
+	}{
+		{
+			name: "success", attempts: 3, backoff: 1 * time.Minute, maxBackoff: 1 * time.Hour,
+			errs:  nil,
+			calls: 1,
+		},
+		{
+			name: "transient retried", attempts: 3, backoff: 1 * time.Minute, maxBackoff: 1 * time.Hour,
+			errs:     []error{transientErr, transientErr},
+			calls:    3,
+			waits:    []time.Duration{1 * time.Minute, 2 * time.Minute},
+			failures: []int{1, 2},
+			retries:  []bool{true, true},
+		},
+		{
+			name: "transient attempts exhausted", attempts: 3, backoff: 1 * time.Minute, maxBackoff: 1 * time.Hour,
+			errs:     []error{transientErr, transientErr, transientErr},
+			err:      transientErr,
+			calls:    3,
+			waits:    []time.Duration{1 * time.Minute, 2 * time.Minute},
+			failures: []int{1, 2, 3},
+			retries:  []bool{true, true, false},
+		},
+		{
+			name: "permanent not retried", attempts: 3, backoff: 1 * time.Minute, maxBackoff: 1 * time.Hour,
+			errs:     []error{permanentErr},
+			err:      permanentErr,
+			calls:    1,
+			failures: []int{1},
+			retries:  []bool{false},
+		},
+		{
+			name: "permanent after transient", attempts: 3, backoff: 1 * time.Minute, maxBackoff: 1 * time.Hour,
+			errs:     []error{transientErr, permanentErr},
+			err:      permanentErr,
+			calls:    2,
+			waits:    []time.Duration{1 * time.Minute},
+			failures: []int{1, 2},
+			retries:  []bool{true, false},
+		},
+		{
+			name: "backoff capped", attempts: 6, backoff: 1 * time.Minute, maxBackoff: 5 * time.Minute,
+			errs:     []error{transientErr, transientErr, transientErr, transientErr, transientErr},
+			calls:    6,
+			waits:    []time.Duration{1 * time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute},
+			failures: []int{1, 2, 3, 4, 5},
+			retries:  []bool{true, true, true, true, true},
+		},
+		{
+			name: "initial backoff over cap", attempts: 3, backoff: 2 * time.Hour, maxBackoff: 1 * time.Hour,
+			errs:     []error{transientErr, transientErr},
+			calls:    3,
+			waits:    []time.Duration{2 * time.Hour, 2 * time.Hour},
+			failures: []int{1, 2},
+			retries:  []bool{true, true},
+		},
+		{
+			name: "deadline cutoff", attempts: 5, backoff: 1 * time.Minute, maxBackoff: 1 * time.Hour, window: 3 * time.Minute,
+			errs:     []error{transientErr, transientErr, transientErr},
+			err:      transientErr,
+			calls:    3,
+			waits:    []time.Duration{1 * time.Minute, 2 * time.Minute},
+			failures: []int{1, 2, 3},
+			retries:  []bool{true, true, false},
+		},
+	} {
+		scheduler, retry := makeTestRetryScheduler(t, test.attempts, test.backoff, test.maxBackoff)
+		f, calls := makeTestRetryFunc(test.errs...)
+
+		var ctx = context.Background()
+
+		if test.window != 0 {
+			deadlineCtx, cancel := context.WithTimeout(ctx, test.window)
+			defer cancel()
+
+			ctx = deadlineCtx
+		}
+
+		var err = scheduler.runRetry(ctx, f)
+
+		if test.err == nil {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Equal(t, test.err, err, test.name)
+		}
+
+		assert.Equal(t, test.calls, *calls, "%v: calls", test.name)
+		assert.Equal(t, test.waits, retry.waits, "%v: waits", test.name)
+		assert.Equal(t, test.failures, retry.attempts, "%v: failures", test.name)
+		assert.Equal(t, test.retries, retry.retries, "%v: retries", test.name)
+	}
+}
+
+func TestRunRetryCancel(t *testing.T) {
+	scheduler, _ := makeTestRetryScheduler(t, 3, 1*time.Minute, 1*time.Hour)
+	scheduler.after = time.After
+
+	var transientErr = fmt.Errorf("transient")
+	var ctx, cancel = context.WithCancel(context.Background())
+
+	f, calls := makeTestRetryFunc(transientErr, transientErr)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	assert.Equal(t, transientErr, scheduler.runRetry(ctx, f))
+	assert.Equal(t, 1, *calls, "not retried once cancelled")
+}
+
+func TestScheduleRebootForce(t *testing.T) {
+	schedule, err := cron.ParseStandard("0 3 * * *")
+	if err != nil {
+		t.Fatalf("ParseStandard: %v", err)
+	}
+
+	var scheduler = Scheduler{location: time.UTC, reboot: schedule}
+
+	var rebootTime = scheduler.ScheduleReboot(true)
+	defer scheduler.rebootTimer.Stop()
+
+	assert.Equal(t, rebootTime, scheduler.ScheduleReboot(false), "pending reboot is not rescheduled")
+	assert.True(t, scheduler.clearReboot(), "pending reboot remains forced")
+
+	scheduler.ScheduleReboot(false)
+	defer scheduler.rebootTimer.Stop()
+
+	assert.False(t, scheduler.clearReboot(), "forced reboot is reset once cleared")
+}
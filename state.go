@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const StateFile = "state.json"
+
+// persisted across pod restarts and host reboots, in the optional --state-path
+type State struct {
+	path  string // empty if not persisted
+	mutex sync.Mutex
+
+	LastRun time.Time `json:"lastRun,omitempty"` // start of the last successful upgrade
+}
+
+func loadState(options Options) (*State, error) {
+	var state State
+
+	if options.StatePath == "" {
+		log.Printf("No --state-path given, not persisting state")
+
+		return &state, nil
+	} else if stat, err := os.Stat(options.StatePath); err != nil && os.IsNotExist(err) {
+		// existing deployments may be missing the new host mount
+		log.Printf("Skipping non-existing --state-path=%v, missed scheduled upgrades will not be caught up! Bind-mount the --state-path from a persistent host path to persist state", options.StatePath)
+
+		return &state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Invalid --state-path=%v: %v", options.StatePath, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("Invalid --state-path=%v: not a directory", options.StatePath)
+	} else {
+		state.path = filepath.Join(options.StatePath, StateFile)
+	}
+
+	if data, err := ioutil.ReadFile(state.path); err != nil && os.IsNotExist(err) {
+		log.Printf("Using --state-path=%v, no existing state", options.StatePath)
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read state from %v: %v", state.path, err)
+	} else if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Invalid state in %v: %v", state.path, err)
+	} else {
+		log.Printf("Using --state-path=%v, last run at %v", options.StatePath, state.LastRun)
+	}
+
+	return &state, nil
+}
+
+// atomically replace the state file, must be called with the mutex held
+func (state *State) save() error {
+	var tempPath = state.path + ".tmp"
+
+	if state.path == "" {
+		return nil
+	} else if data, err := json.Marshal(state); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	} else if err := os.Rename(tempPath, state.path); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func (state *State) GetLastRun() time.Time {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	return state.LastRun
+}
+
+func (state *State) SetLastRun(t time.Time) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.LastRun = t
+
+	if err := state.save(); err != nil {
+		return fmt.Errorf("Failed to save state to %v: %v", state.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package systemd
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus"
+)
+
+// private system bus connection, must be closed
+func systemBus() (*dbus.Conn, error) {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return nil, fmt.Errorf("dbus.SystemBusPrivate: %v", err)
+	}
+
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus.Auth: %v", err)
+	} else if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus.Hello: %v", err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,72 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// systemd-logind inhibitor lock, see systemd-inhibit(1)
+//
+// The field order matches the login1 ListInhibitors a(ssssuu) struct.
+type Inhibitor struct {
+	What string // colon-separated list, e.g. shutdown:sleep
+	Who  string
+	Why  string
+	Mode string // block or delay
+	UID  uint32
+	PID  uint32
+}
+
+func (inhibitor Inhibitor) String() string {
+	return fmt.Sprintf("%v (%v)", inhibitor.Who, inhibitor.Why)
+}
+
+// blocks the shutdown, as opposed to only delaying it
+func (inhibitor Inhibitor) BlocksShutdown() bool {
+	if inhibitor.Mode != "block" {
+		return false
+	}
+
+	for _, what := range strings.Split(inhibitor.What, ":") {
+		if what == "shutdown" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ListInhibitors() ([]Inhibitor, error) {
+	conn, err := systemBus()
+	if err != nil {
+		return nil, err
+	} else {
+		defer conn.Close()
+	}
+
+	var inhibitors []Inhibitor
+
+	if err := conn.Object(login1Dest, login1Path).Call(login1Interface+".ListInhibitors", 0).Store(&inhibitors); err != nil {
+		return nil, fmt.Errorf("login1.ListInhibitors: %v", err)
+	}
+
+	return inhibitors, nil
+}
+
+// returns any inhibitors currently blocking the host shutdown
+func ListShutdownInhibitors() ([]Inhibitor, error) {
+	inhibitors, err := ListInhibitors()
+	if err != nil {
+		return nil, err
+	}
+
+	var blocking []Inhibitor
+
+	for _, inhibitor := range inhibitors {
+		if inhibitor.BlocksShutdown() {
+			blocking = append(blocking, inhibitor)
+		}
+	}
+
+	return blocking, nil
+}
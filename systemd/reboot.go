@@ -2,21 +2,22 @@ package systemd
 
 import (
 	"fmt"
-
-	"github.com/coreos/go-systemd/login1"
 )
 
-func Reboot() error {
-	conn, err := login1.New()
+const login1Dest = "org.freedesktop.login1"
+const login1Path = "/org/freedesktop/login1"
 
+func Reboot() error {
+	conn, err := systemBus()
 	if err != nil {
-		return fmt.Errorf("login1.New: %v", err)
+		return err
 	} else {
 		defer conn.Close()
 	}
 
-	// XXX: WTF... no error return?
-	conn.Reboot(false)
+	if call := conn.Object(login1Dest, login1Path).Call(login1Interface+".Reboot", 0, false); call.Err != nil {
+		return fmt.Errorf("login1.Reboot: %v", call.Err)
+	}
 
 	return nil
 }
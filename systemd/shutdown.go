@@ -0,0 +1,66 @@
+package systemd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const login1Interface = "org.freedesktop.login1.Manager"
+const prepareForShutdownSignal = login1Interface + ".PrepareForShutdown"
+
+// Watches for the login1 PrepareForShutdown signal, sent once the host shutdown has started
+type ShutdownWatcher struct {
+	conn    *dbus.Conn
+	signals chan *dbus.Signal
+}
+
+// Start watching before requesting the reboot, to not miss the signal
+func WatchShutdown() (*ShutdownWatcher, error) {
+	conn, err := systemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	var match = fmt.Sprintf("type='signal',interface='%v',member='PrepareForShutdown'", login1Interface)
+	var watcher = ShutdownWatcher{
+		conn:    conn,
+		signals: make(chan *dbus.Signal, 10),
+	}
+
+	if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, match); call.Err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus.AddMatch %v: %v", match, call.Err)
+	}
+
+	conn.Signal(watcher.signals)
+
+	return &watcher, nil
+}
+
+// Returns true once the shutdown has started, or false on timeout
+func (watcher *ShutdownWatcher) Wait(timeout time.Duration) bool {
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case signal, ok := <-watcher.signals:
+			if !ok {
+				return false
+			} else if signal.Name != prepareForShutdownSignal || len(signal.Body) < 1 {
+				continue
+			} else if start, ok := signal.Body[0].(bool); ok && start {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (watcher *ShutdownWatcher) Close() {
+	watcher.conn.RemoveSignal(watcher.signals)
+	watcher.conn.Close()
+}
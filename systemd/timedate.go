@@ -0,0 +1,26 @@
+package systemd
+
+import (
+	"fmt"
+)
+
+const timedateDest = "org.freedesktop.timedate1"
+const timedatePath = "/org/freedesktop/timedate1"
+
+// Returns the host time zone configured in systemd-timedated, e.g. Europe/Helsinki
+func GetTimezone() (string, error) {
+	conn, err := systemBus()
+	if err != nil {
+		return "", err
+	} else {
+		defer conn.Close()
+	}
+
+	if variant, err := conn.Object(timedateDest, timedatePath).GetProperty(timedateDest + ".Timezone"); err != nil {
+		return "", fmt.Errorf("timedate1.GetProperty Timezone: %v", err)
+	} else if timezone, ok := variant.Value().(string); !ok {
+		return "", fmt.Errorf("timedate1.GetProperty Timezone: invalid value %v", variant)
+	} else {
+		return timezone, nil
+	}
+}